@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"guptaspi/auth"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit event types
+const (
+	eventLogin           = "login"
+	eventLogout          = "logout"
+	eventRefresh         = "refresh"
+	eventRefreshReuse    = "refresh_reuse"
+	eventRequestRejected = "request_rejected"
+	eventUserCreated     = "user_created"
+	eventUserUpdated     = "user_updated"
+	eventUserDeleted     = "user_deleted"
+	eventPasswordChanged = "password_changed"
+	eventTokensRevoked   = "tokens_revoked"
+	eventKeyCreated      = "key_created"
+	eventKeyDeleted      = "key_deleted"
+)
+
+// Audit outcomes
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+type AuditEvent struct {
+	Id        uint64    `json:"id"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	UserId    *uint64   `json:"user_id"`
+	Username  string    `json:"username"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Detail    string    `json:"detail"`
+}
+
+// auditRetention reads how long audit events are kept from AUDIT_RETENTION_DAYS, 90 days by default.
+func auditRetention() time.Duration {
+	days := 90
+	if value := os.Getenv("AUDIT_RETENTION_DAYS"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			log.Printf("Invalid AUDIT_RETENTION_DAYS %q, using %d", value, days)
+		} else {
+			days = n
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// audit records an event. userId 0 means the user is unknown.
+// Failing to write the event is logged but never fails the request.
+func (amw *authentication) audit(r *http.Request, event string, outcome string, userId uint64, username string, detail string) {
+	var id sql.NullInt64
+	if userId != 0 {
+		id = sql.NullInt64{Int64: int64(userId), Valid: true}
+	}
+
+	var ip string
+	if clientAddr := clientIP(r, amw.trustedProxies); clientAddr != nil {
+		ip = clientAddr.String()
+	}
+
+	_, err := amw.db.Exec(
+		"INSERT INTO audit_events (time, event, outcome, user_id, username, ip, user_agent, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		time.Now().UTC(), event, outcome, id, username, ip, truncate(r.UserAgent(), 512), truncate(detail, 1024),
+	)
+	if err != nil {
+		log.Printf("Error writing audit event %s: %v\n", event, err)
+	}
+}
+
+// actorName returns the username of whoever made the request, for event details.
+func actorName(r *http.Request) string {
+	if identity, ok := auth.FromRequest(r); ok {
+		return identity.Username
+	}
+	return ""
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// AddAuditRouter installs the audit log endpoint.
+// r is a subrouter that is already restricted to admins.
+func (amw *authentication) AddAuditRouter(r *mux.Router) {
+	r.HandleFunc("/audit", amw.listAuditEvents).Methods("GET")
+}
+
+// listAuditEvents corresponds to the GET /admin/audit endpoint.
+// Events are returned newest first and can be filtered by event, outcome, user_id, ip, since and until.
+func (amw *authentication) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	var conditions []string
+	var args []interface{}
+
+	for _, column := range []string{"event", "outcome", "ip"} {
+		if value := r.FormValue(column); value != "" {
+			conditions = append(conditions, column+" = ?")
+			args = append(args, value)
+		}
+	}
+
+	if value := r.FormValue("user_id"); value != "" {
+		userId, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, userId)
+	}
+
+	for param, condition := range map[string]string{"since": "time >= ?", "until": "time < ?"} {
+		if value := r.FormValue(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, condition)
+			args = append(args, t.UTC())
+		}
+	}
+
+	page, perPage, ok := pagination(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT id, time, event, outcome, user_id, username, ip, user_agent, detail FROM audit_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, perPage, (page-1)*perPage)
+
+	rows, err := amw.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error when querying audit events: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event := AuditEvent{}
+		var userId sql.NullInt64
+		err := rows.Scan(&event.Id, &event.Time, &event.Event, &event.Outcome, &userId, &event.Username, &event.Ip, &event.UserAgent, &event.Detail)
+		if err != nil {
+			log.Printf("Error when scanning audit events: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if userId.Valid {
+			id := uint64(userId.Int64)
+			event.UserId = &id
+		}
+		events = append(events, &event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Page", strconv.Itoa(page))
+	w.Header().Set("X-Per-Page", strconv.Itoa(perPage))
+	_ = json.NewEncoder(w).Encode(events)
+}
+
+// pagination reads the page (starting at 1) and per_page query params.
+func pagination(r *http.Request) (page int, perPage int, ok bool) {
+	page, perPage = 1, 50
+
+	if value := r.FormValue("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, false
+		}
+		page = n
+	}
+	if value := r.FormValue("per_page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 500 {
+			return 0, 0, false
+		}
+		perPage = n
+	}
+
+	return page, perPage, true
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Identity describes the authenticated user making a request.
+type Identity struct {
+	UserId   uint64
+	Username string
+	Role     string
+	// KeyId is set when the request was signed with a signing key instead of carrying an access token
+	KeyId string
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity.
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity stored in ctx by the authentication middleware, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok
+}
+
+// FromRequest is a shorthand for FromContext(r.Context()).
+func FromRequest(r *http.Request) (*Identity, bool) {
+	return FromContext(r.Context())
+}
+
+// IsAdmin reports whether the request was made by an admin user.
+func IsAdmin(r *http.Request) bool {
+	identity, ok := FromRequest(r)
+	return ok && identity.Role == RoleAdmin
+}
+
+// AdminOnly only lets requests from admin users through to next, others get 403.
+// Packages use it for endpoints outside the /admin prefix that only admins may call.
+func AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsAdmin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-sql-driver/mysql"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"guptaspi/auth"
 	"log"
 	"net/http"
 	"os"
@@ -25,19 +26,36 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError responds with the status code and a JSON body explaining it.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(Error{Code: code, Message: message})
+}
+
 type User struct {
-	Id       uint64 `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Id              uint64       `json:"id"`
+	Username        string       `json:"username"`
+	Password        string       `json:"password"`
+	Role            string       `json:"role"`
+	Disabled        bool         `json:"disabled"`
+	LastLogin       sql.NullTime `json:"last_login"`
+	AllowedNetworks string       `json:"allowed_networks"`
 }
 
 type Token struct {
-	AccessToken  string
-	RefreshToken string
-	AccessUuid   string
-	RefreshUuid  string
-	AtExpires    int64
-	RtExpires    int64
+	AccessToken     string
+	RefreshToken    string
+	AccessUuid      string
+	RefreshUuid     string
+	AtExpires       int64
+	RtExpires       int64
+	AllowedNetworks string
 }
 
 type AccessDetails struct {
@@ -52,7 +70,14 @@ type authentication struct {
 	RefreshSecret         string
 	db                    *sql.DB
 	userStmt              *sql.Stmt
+	sessionStmt           *sql.Stmt
+	passwordPolicy        passwordPolicy
+	trustedProxies        networkList
+	nonces                nonceCache
+	auditRetention        time.Duration
 	expirationCtx         context.Context
+	// dummyHash is checked for unknown users so their logins take as long as ones with a wrong password
+	dummyHash string
 }
 
 func (amw *authentication) Initialize() {
@@ -62,13 +87,25 @@ func (amw *authentication) Initialize() {
 	amw.AccessSecret = os.Getenv("ACCESS_SECRET")
 	amw.RefreshSecret = os.Getenv("REFRESH_SECRET")
 
+	amw.passwordPolicy = loadPasswordPolicy()
+	amw.auditRetention = auditRetention()
+
+	var err error
+	amw.dummyHash, err = hashPassword(uuid.New().String())
+	if err != nil {
+		log.Fatalf("Error hashing the dummy password: %v\n", err)
+	}
+	amw.trustedProxies, err = parseNetworks(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Error parsing TRUSTED_PROXIES: %v\n", err)
+	}
+
 	config := mysql.NewConfig()
 	config.User = os.Getenv("MYSQL_USER")
 	config.Passwd = os.Getenv("MYSQL_PASS")
 	config.Addr = "localhost:3306"
 	config.DBName = "guptaspi"
 
-	var err error
 	amw.db, err = sql.Open("mysql", config.FormatDSN())
 	if err != nil {
 		panic(err)
@@ -78,7 +115,21 @@ func (amw *authentication) Initialize() {
 	amw.db.SetMaxOpenConns(10)
 	amw.db.SetMaxIdleConns(10)
 
-	amw.userStmt, err = amw.db.Prepare("SELECT id, username, password FROM users WHERE username = ?")
+	if err = migrate(amw.db); err != nil {
+		log.Fatalf("Error migrating database: %v\n", err)
+	}
+	if err = amw.seedAdmin(); err != nil {
+		log.Fatalf("Error creating the first admin: %v\n", err)
+	}
+
+	amw.userStmt, err = amw.db.Prepare("SELECT id, username, password, role, disabled, last_login, allowed_networks FROM users WHERE username = ?")
+	if err != nil {
+		log.Fatalf("Error creating prepared statement: %v\n", err)
+	}
+
+	amw.sessionStmt, err = amw.db.Prepare(
+		"SELECT u.id, u.username, u.role, u.disabled, u.allowed_networks, a.allowed_networks FROM access_tokens a JOIN users u ON u.id = a.user_id WHERE a.access_uuid = ?",
+	)
 	if err != nil {
 		log.Fatalf("Error creating prepared statement: %v\n", err)
 	}
@@ -89,21 +140,87 @@ func (amw *authentication) Initialize() {
 	go amw.deleteExpired(amw.expirationCtx)
 }
 
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+)
+
+// Middleware authenticates every request except logins and metrics scrapes, either by access token or by request signature.
 func (amw *authentication) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.RequestURI == "/auth/login" {
+		if r.URL.Path == "/auth/login" || r.URL.Path == "/metrics" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		err := tokenValid(r)
-		if err != nil {
+
+		var identity *auth.Identity
+		var err error
+		if isSignedRequest(r) {
+			identity, err = amw.verifySignature(r)
+		} else {
+			identity, err = amw.verifySession(r)
+		}
+
+		switch {
+		case errors.Is(err, errUnauthorized):
+			// Expired access tokens are routine, bad signatures are not
+			if isSignedRequest(r) {
+				amw.audit(r, eventRequestRejected, outcomeFailure, 0, "", err.Error())
+			}
 			w.WriteHeader(http.StatusUnauthorized)
 			return
+		case errors.Is(err, errForbidden):
+			amw.audit(r, eventRequestRejected, outcomeFailure, identity.UserId, identity.Username, err.Error())
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("Error authenticating request: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		next.ServeHTTP(w, r)
+
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), identity)))
 	})
 }
 
+// verifySession authenticates a request carrying an access token.
+func (amw *authentication) verifySession(r *http.Request) (*auth.Identity, error) {
+	ad, err := extractTokenMetadata(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+
+	// The access token must still be stored, otherwise it was logged out or revoked
+	identity := auth.Identity{}
+	var disabled bool
+	var userNetworks, tokenNetworks string
+	err = amw.sessionStmt.QueryRow(ad.AccessUuid).Scan(
+		&identity.UserId, &identity.Username, &identity.Role, &disabled, &userNetworks, &tokenNetworks,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("%w: access token revoked", errUnauthorized)
+	case err != nil:
+		return nil, err
+	}
+
+	// Forbidden errors come with the identity, so the rejection can be attributed
+	if disabled {
+		return &identity, fmt.Errorf("%w: user %s is disabled", errForbidden, identity.Username)
+	}
+	if ip := clientIP(r, amw.trustedProxies); !networksAllow(ip, userNetworks, tokenNetworks) {
+		return &identity, fmt.Errorf("%w: address %v not allowed for user %s", errForbidden, ip, identity.Username)
+	}
+
+	return &identity, nil
+}
+
+// AdminMiddleware only lets requests from admin users through.
+// It must run after Middleware.
+func (amw *authentication) AdminMiddleware(next http.Handler) http.Handler {
+	return auth.AdminOnly(next)
+}
+
 func extractTokenMetadata(r *http.Request) (*AccessDetails, error) {
 	token, err := verifyToken(r)
 	if err != nil {
@@ -127,17 +244,6 @@ func extractTokenMetadata(r *http.Request) (*AccessDetails, error) {
 	return nil, err
 }
 
-func tokenValid(r *http.Request) error {
-	token, err := verifyToken(r)
-	if err != nil {
-		return err
-	}
-	if _, ok := token.Claims.(jwt.Claims); !ok && !token.Valid {
-		return err
-	}
-	return nil
-}
-
 func verifyToken(r *http.Request) (*jwt.Token, error) {
 	tokenString := extractToken(r)
 
@@ -169,6 +275,7 @@ func (amw *authentication) CreateUser(w http.ResponseWriter, r *http.Request) {
 	body := struct {
 		UserName string `json:"user_name"`
 		Password string `json:"password"`
+		Role     string `json:"role"`
 	}{}
 	err := decoder.Decode(&body)
 	if err != nil {
@@ -177,21 +284,75 @@ func (amw *authentication) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if body.Role == "" {
+		body.Role = auth.RoleUser
+	}
+	if !validRole(body.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.UserName == "" {
+		writeError(w, http.StatusBadRequest, "username must not be empty")
+		return
+	}
+	if err := amw.passwordPolicy.check(body.UserName, body.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hash, err := hashPassword(body.Password)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	_, err = amw.db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", body.UserName, hash)
+	res, err := amw.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", body.UserName, hash, body.Role)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	var userId uint64
+	if id, err := res.LastInsertId(); err == nil {
+		userId = uint64(id)
+	}
+	amw.audit(r, eventUserCreated, outcomeSuccess, userId, body.UserName, "role "+body.Role+" created by "+actorName(r))
+
 	w.WriteHeader(http.StatusCreated)
 }
 
+// seedAdmin creates an admin from ADMIN_USERNAME and ADMIN_PASSWORD while there are no users,
+// since only admins can create users. Once any user exists the variables are ignored.
+func (amw *authentication) seedAdmin() error {
+	var count int
+	if err := amw.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	username, password := os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		log.Printf("There are no users, set ADMIN_USERNAME and ADMIN_PASSWORD to create the first admin")
+		return nil
+	}
+	if err := amw.passwordPolicy.check(username, password); err != nil {
+		return fmt.Errorf("ADMIN_PASSWORD: %w", err)
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := amw.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", username, hash, auth.RoleAdmin); err != nil {
+		return err
+	}
+	log.Printf("Created the first admin %s", username)
+	return nil
+}
+
 func (amw *authentication) Login(w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -201,9 +362,21 @@ func (amw *authentication) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	user := User{}
 
-	err := amw.userStmt.QueryRow(username).Scan(&user.Id, &user.Username, &user.Password)
+	// Clients can restrict the new tokens to fewer networks than the user is allowed to use
+	tokenNetworks, err := parseNetworks(r.FormValue("networks"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = amw.userStmt.QueryRow(username).Scan(
+		&user.Id, &user.Username, &user.Password, &user.Role, &user.Disabled, &user.LastLogin, &user.AllowedNetworks,
+	)
 	switch {
 	case err == sql.ErrNoRows:
+		_, _, _ = verifyPassword(amw.dummyHash, password)
+		amw.audit(r, eventLogin, outcomeFailure, 0, username, "unknown user")
+		loginsTotal.Inc(outcomeFailure)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	case err != nil:
@@ -212,15 +385,35 @@ func (amw *authentication) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+	match, rehash, err := verifyPassword(user.Password, password)
+	if err != nil {
+		log.Printf("Error verifying password: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !match {
+		amw.audit(r, eventLogin, outcomeFailure, user.Id, user.Username, "wrong password")
+		loginsTotal.Inc(outcomeFailure)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
+	} else if user.Disabled {
+		amw.audit(r, eventLogin, outcomeFailure, user.Id, user.Username, "user is disabled")
+		loginsTotal.Inc(outcomeFailure)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if ip := clientIP(r, amw.trustedProxies); !networksAllow(ip, user.AllowedNetworks) {
+		amw.audit(r, eventLogin, outcomeFailure, user.Id, user.Username, "address not allowed")
+		loginsTotal.Inc(outcomeFailure)
+		w.WriteHeader(http.StatusForbidden)
+		return
 	} else {
 		token, err := amw.createToken(user.Id)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		token.AllowedNetworks = tokenNetworks.String()
 
 		err = amw.createAuth(user.Id, token)
 		if err != nil {
@@ -228,6 +421,21 @@ func (amw *authentication) Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		_, err = amw.db.Exec("UPDATE users SET last_login = ? WHERE id = ?", time.Now(), user.Id)
+		if err != nil {
+			log.Printf("Error updating last login: %v\n", err)
+		}
+
+		// Upgrade bcrypt hashes and outdated argon2 parameters now that the password is known
+		if rehash {
+			if err := amw.setPassword(user.Id, password); err != nil {
+				log.Printf("Error rehashing password: %v\n", err)
+			}
+		}
+
+		amw.audit(r, eventLogin, outcomeSuccess, user.Id, user.Username, "")
+		loginsTotal.Inc(outcomeSuccess)
+
 		tokens := map[string]string{
 			"access_token":  token.AccessToken,
 			"refresh_token": token.RefreshToken,
@@ -238,6 +446,67 @@ func (amw *authentication) Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (amw *authentication) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	identity, ok := sessionIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("Error decoding JSON: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var hash string
+	if err := amw.db.QueryRow("SELECT password FROM users WHERE id = ?", identity.UserId).Scan(&hash); err != nil {
+		log.Printf("Error when querying user: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	match, _, err := verifyPassword(hash, body.OldPassword)
+	if err != nil {
+		log.Printf("Error verifying password: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !match {
+		amw.audit(r, eventPasswordChanged, outcomeFailure, identity.UserId, identity.Username, "wrong password")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := amw.passwordPolicy.check(identity.Username, body.NewPassword); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := amw.setPassword(identity.UserId, body.NewPassword); err != nil {
+		log.Printf("Error changing password: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	amw.audit(r, eventPasswordChanged, outcomeSuccess, identity.UserId, identity.Username, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword hashes the password and stores it for the user. The password policy must be checked beforehand.
+func (amw *authentication) setPassword(userId uint64, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = amw.db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userId)
+	return err
+}
+
 func (amw *authentication) Logout(w http.ResponseWriter, r *http.Request) {
 	au, err := extractTokenMetadata(r)
 	if err != nil {
@@ -249,6 +518,7 @@ func (amw *authentication) Logout(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	amw.audit(r, eventLogout, outcomeSuccess, au.UserId, actorName(r), "")
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -313,13 +583,19 @@ func (amw *authentication) createAuth(userid uint64, td *Token) error {
 		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO access_tokens (user_id, access_uuid, expires) VALUES (?, ?, ?)", userid, td.AccessUuid, at)
+	_, err = tx.Exec(
+		"INSERT INTO access_tokens (user_id, access_uuid, expires, allowed_networks) VALUES (?, ?, ?, ?)",
+		userid, td.AccessUuid, at, td.AllowedNetworks,
+	)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
 	}
 
-	_, err = tx.Exec("INSERT INTO refresh_tokens (user_id, refresh_uuid, expires) VALUES (?, ?, ?)", userid, td.RefreshUuid, rt)
+	_, err = tx.Exec(
+		"INSERT INTO refresh_tokens (user_id, refresh_uuid, expires, allowed_networks) VALUES (?, ?, ?, ?)",
+		userid, td.RefreshUuid, rt, td.AllowedNetworks,
+	)
 	if err != nil {
 		_ = tx.Rollback()
 		return err
@@ -381,12 +657,46 @@ func (amw *authentication) Refresh(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err = amw.db.Exec("DELETE FROM refresh_tokens WHERE refresh_uuid = ?", refreshUuid)
+		var disabled bool
+		var userNetworks, tokenNetworks string
+		err = amw.db.QueryRow(
+			"SELECT u.disabled, u.allowed_networks, t.allowed_networks FROM refresh_tokens t JOIN users u ON u.id = t.user_id WHERE t.refresh_uuid = ? AND t.user_id = ?",
+			refreshUuid, userId,
+		).Scan(&disabled, &userNetworks, &tokenNetworks)
+		switch {
+		case err == sql.ErrNoRows:
+			// The signature is valid, so the token was issued by us and has been used or revoked before
+			amw.audit(r, eventRefreshReuse, outcomeFailure, userId, "", "refresh token "+refreshUuid)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case err != nil:
+			log.Printf("Error getting user: %v\n", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if disabled {
+			amw.audit(r, eventRefresh, outcomeFailure, userId, "", "user is disabled")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if ip := clientIP(r, amw.trustedProxies); !networksAllow(ip, userNetworks, tokenNetworks) {
+			amw.audit(r, eventRefresh, outcomeFailure, userId, "", "address not allowed")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		res, err := amw.db.Exec("DELETE FROM refresh_tokens WHERE refresh_uuid = ?", refreshUuid)
 		if err != nil {
 			log.Printf("Error deleting previous Refresh Token: %v\n", err)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		// A concurrent refresh with the same token got there first
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			amw.audit(r, eventRefreshReuse, outcomeFailure, userId, "", "refresh token "+refreshUuid)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
 		ts, err := amw.createToken(userId)
 		if err != nil {
@@ -394,6 +704,7 @@ func (amw *authentication) Refresh(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		ts.AllowedNetworks = tokenNetworks
 
 		err = amw.createAuth(userId, ts)
 		if err != nil {
@@ -402,6 +713,8 @@ func (amw *authentication) Refresh(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		amw.audit(r, eventRefresh, outcomeSuccess, userId, "", "")
+
 		tokens := map[string]string{
 			"access_token":  ts.AccessToken,
 			"refresh_token": ts.RefreshToken,
@@ -419,17 +732,22 @@ func (amw *authentication) deleteExpired(ctx context.Context) {
 	log.Printf("Starting deletion of expired tokens...")
 	stmt, err := amw.db.Prepare("DELETE FROM access_tokens WHERE expires < ?")
 	stmt2, err2 := amw.db.Prepare("DELETE FROM refresh_tokens WHERE expires < ?")
+	stmt3, err3 := amw.db.Prepare("DELETE FROM audit_events WHERE time < ?")
 	if err != nil {
 		log.Fatalf("Error creating prepared statement: %v\n", err)
 	}
 	if err2 != nil {
 		log.Fatalf("Error creating prepared statement: %v\n", err2)
 	}
+	if err3 != nil {
+		log.Fatalf("Error creating prepared statement: %v\n", err3)
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Stopping deletion of expired tokens...")
 		default:
+			tokenCleanupRuns.Inc()
 			_, err = stmt.Exec(time.Now())
 			if err != nil {
 				log.Printf("Error deleting rows: %v\n", err)
@@ -438,6 +756,10 @@ func (amw *authentication) deleteExpired(ctx context.Context) {
 			if err != nil {
 				log.Printf("Error deleting rows: %v\n", err)
 			}
+			_, err = stmt3.Exec(time.Now().UTC().Add(-amw.auditRetention))
+			if err != nil {
+				log.Printf("Error deleting rows: %v\n", err)
+			}
 			time.Sleep(5 * time.Minute)
 		}
 	}
@@ -0,0 +1,131 @@
+package main
+
+// commonPasswords is a small offline list of common passwords of at least the default minimum length,
+// shorter ones are rejected by the length rule already. Larger lists can be configured with PASSWORD_BREACHED_LIST.
+var commonPasswords = map[string]struct{}{
+	"0000000000":       {},
+	"0123456789":       {},
+	"0987654321":       {},
+	"1111111111":       {},
+	"1212121212":       {},
+	"123123123123":     {},
+	"1234512345":       {},
+	"1234554321":       {},
+	"1234567890":       {},
+	"1234567890a":      {},
+	"1234567890q":      {},
+	"12345678910":      {},
+	"123456789a":       {},
+	"123456789abc":     {},
+	"123456789q":       {},
+	"12345qwert":       {},
+	"1234qwerty":       {},
+	"123qweasdzxc":     {},
+	"1q2w3e4r5t":       {},
+	"1q2w3e4r5t6y":     {},
+	"1qaz2wsx3edc":     {},
+	"1qaz2wsx3edc4rfv": {},
+	"2222222222":       {},
+	"5555555555":       {},
+	"7777777777":       {},
+	"8888888888":       {},
+	"9876543210":       {},
+	"987654321a":       {},
+	"9999999999":       {},
+	"a1b2c3d4e5":       {},
+	"aaaaaaaaaa":       {},
+	"abc1234567":       {},
+	"abcd123456":       {},
+	"abcdef123456":     {},
+	"abcdefghij":       {},
+	"admin12345":       {},
+	"admin123456":      {},
+	"admin@1234":       {},
+	"adminadmin":       {},
+	"administrator":    {},
+	"administrator1":   {},
+	"arsenal123":       {},
+	"asdfasdfasdf":     {},
+	"asdfghjkl1":       {},
+	"asdfghjkl123":     {},
+	"asdfghjkl;":       {},
+	"barcelona1":       {},
+	"baseball123":      {},
+	"basketball":       {},
+	"basketball1":      {},
+	"batman12345":      {},
+	"butterfly1":       {},
+	"changeme123":      {},
+	"charlie123":       {},
+	"chelsea123":       {},
+	"chocolate1":       {},
+	"computer12":       {},
+	"computer123":      {},
+	"dragon1234":       {},
+	"football123":      {},
+	"football1234":     {},
+	"iloveyou12":       {},
+	"iloveyou123":      {},
+	"iloveyou1234":     {},
+	"internet123":      {},
+	"jennifer123":      {},
+	"letmein123":       {},
+	"letmeinplease":    {},
+	"liverpool1":       {},
+	"liverpool123":     {},
+	"manchester":       {},
+	"manchester1":      {},
+	"master1234":       {},
+	"michael123":       {},
+	"minecraft1":       {},
+	"minecraft123":     {},
+	"monkey1234":       {},
+	"mypassword":       {},
+	"mypassword1":      {},
+	"mypassword123":    {},
+	"newpassword":      {},
+	"p@ssw0rd123":      {},
+	"p@ssword123":      {},
+	"passw0rd123":      {},
+	"password01":       {},
+	"password1!":       {},
+	"password12":       {},
+	"password123":      {},
+	"password1234":     {},
+	"password12345":    {},
+	"password123456":   {},
+	"passwordpassword": {},
+	"pineapple1":       {},
+	"playstation":      {},
+	"playstation1":     {},
+	"pokemon123":       {},
+	"princess123":      {},
+	"q1w2e3r4t5":       {},
+	"q1w2e3r4t5y6":     {},
+	"qazwsxedc123":     {},
+	"qazwsxedcrfv":     {},
+	"qwerty1234":       {},
+	"qwerty12345":      {},
+	"qwerty123456":     {},
+	"qwertyqwerty":     {},
+	"qwertyuiop":       {},
+	"qwertyuiop123":    {},
+	"raspberry123":     {},
+	"raspberrypi":      {},
+	"rootpassword":     {},
+	"shadow1234":       {},
+	"spiderman1":       {},
+	"spongebob1":       {},
+	"starwars123":      {},
+	"strawberry":       {},
+	"sunshine123":      {},
+	"superman123":      {},
+	"welcome123":       {},
+	"welcome1234":      {},
+	"welcome@123":      {},
+	"whatever123":      {},
+	"zaq12wsxcde3":     {},
+	"zaq1zaq1zaq1":     {},
+	"zxcvbnm,./":       {},
+	"zxcvbnm123":       {},
+}
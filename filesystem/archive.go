@@ -0,0 +1,364 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"github.com/gorilla/mux"
+	"guptaspi/info"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	archiveFormatZip   = "zip"
+	archiveFormatTarGz = "tar.gz"
+	// archiveErrorsName is the trailing entry that lists what couldn't be read into the archive
+	archiveErrorsName = "ERRORS.txt"
+)
+
+// archiveWriter writes the entries of one archive format.
+type archiveWriter interface {
+	// addDir adds a folder, name is slash separated and relative to the archive root
+	addDir(name string, stat os.FileInfo) error
+	// addFile adds a file with the content of r, which has the size of stat
+	addFile(name string, stat os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// zipWriter writes a ZIP. archive/zip switches to ZIP64 by itself for files and archives over 4 GiB.
+type zipWriter struct {
+	w *zip.Writer
+}
+
+func (z zipWriter) addDir(name string, stat os.FileInfo) error {
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	_, err = z.w.CreateHeader(header)
+	return err
+}
+
+func (z zipWriter) addFile(name string, stat os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	entry, err := z.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, r)
+	return err
+}
+
+func (z zipWriter) Close() error {
+	return z.w.Close()
+}
+
+// tarGzWriter writes a gzipped tar. archive/tar picks PAX headers for long names and large files.
+type tarGzWriter struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (t tarGzWriter) addDir(name string, stat os.FileInfo) error {
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	return t.w.WriteHeader(header)
+}
+
+func (t tarGzWriter) addFile(name string, stat os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := t.w.WriteHeader(header); err != nil {
+		return err
+	}
+	// The header has the size from before the copy, a file that changed in the meantime fails the archive
+	_, err = io.CopyN(t.w, r, header.Size)
+	return err
+}
+
+func (t tarGzWriter) Close() error {
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// archiveSelection is a folder or file to put in the archive, relative to the volume and to the archive root.
+type archiveSelection struct {
+	relativePath string
+	name         string
+}
+
+// downloadArchive streams folder, or the paths selected below it, as a ZIP or tar.gz without staging it on disk.
+// Errors once the response has started abort the connection, so the client can't take a truncated
+// archive for a complete one.
+func downloadArchive(w http.ResponseWriter, r *http.Request) {
+	volume := mux.Vars(r)["volume"]
+
+	folder := filepath.Clean("/" + r.FormValue("folder"))
+	format := r.FormValue("format")
+	if format == "" {
+		format = archiveFormatZip
+	}
+	if format != archiveFormatZip && format != archiveFormatTarGz {
+		w.WriteHeader(400)
+		return
+	}
+	hidden := false
+	if value := r.FormValue("hidden"); value != "" {
+		var err error
+		hidden, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Hidden query param error, %v", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	drive := info.GetDrive(volume)
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if err := drive.CheckAvailable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+
+	// Without paths the whole folder is archived, with its contents at the archive root
+	var selections []archiveSelection
+	for _, selected := range r.Form["path"] {
+		name := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(selected)), "/")
+		if name == "" {
+			continue
+		}
+		selections = append(selections, archiveSelection{
+			relativePath: filepath.Join(folder, filepath.FromSlash(name)),
+			name:         name,
+		})
+	}
+	if len(selections) == 0 {
+		selections = []archiveSelection{{relativePath: folder}}
+	}
+
+	// Everything selected has to exist before the response starts, later errors can't change the status
+	for _, selection := range selections {
+		target, filePath := drive.LocateDrive(selection.relativePath)
+		err := info.Guard(target.Path, func() error {
+			_, err := os.Lstat(filePath)
+			return err
+		})
+		if os.IsNotExist(err) {
+			w.WriteHeader(404)
+			return
+		} else if err != nil {
+			log.Printf("Error reading path for archive: %v", err)
+			w.WriteHeader(info.ErrorStatus(err))
+			return
+		}
+	}
+
+	archiveName := drive.VolumeLabel
+	if folder != string(filepath.Separator) {
+		archiveName = filepath.Base(folder)
+	}
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": archiveName + "." + format}))
+
+	var archive archiveWriter
+	if format == archiveFormatZip {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = zipWriter{w: zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = tarGzWriter{gz: gz, w: tar.NewWriter(gz)}
+	}
+
+	a := &archiver{ctx: r.Context(), drive: drive, archive: archive, hidden: hidden, added: map[string]bool{}}
+	for _, selection := range selections {
+		if err := a.add(selection.relativePath, selection.name); err != nil {
+			a.abort(err)
+		}
+	}
+	if err := a.addErrors(); err != nil {
+		a.abort(err)
+	}
+	if err := archive.Close(); err != nil {
+		a.abort(err)
+	}
+}
+
+// archiver walks selections of a volume into an archive.
+type archiver struct {
+	ctx     context.Context
+	drive   *info.Drive
+	archive archiveWriter
+	hidden  bool
+	// added holds the names in the archive, so overlapping selections add them once
+	added map[string]bool
+	// skipped lists the entries that couldn't be read, with why
+	skipped []string
+}
+
+// add puts the file or folder at relativePath in the archive under name, folders with everything below them.
+// An empty name is the archive root. Entries that can't be read are skipped and listed in a trailing
+// ERRORS.txt, so the archive still has everything else.
+func (a *archiver) add(relativePath string, name string) error {
+	if err := a.ctx.Err(); err != nil {
+		return err
+	}
+	if a.added[name] {
+		return nil
+	}
+
+	target, filePath := a.drive.LocateDrive(relativePath)
+	var stat os.FileInfo
+	err := info.Guard(target.Path, func() (err error) {
+		stat, err = os.Lstat(filePath)
+		return err
+	})
+	if err == info.ErrUnresponsive {
+		return err
+	} else if err != nil {
+		a.skip(name, err)
+		return nil
+	}
+
+	if stat.IsDir() {
+		return a.addDir(relativePath, name, stat)
+	}
+	// Symlinks aren't followed, they could point outside the volume
+	if !stat.Mode().IsRegular() {
+		return nil
+	}
+	a.added[name] = true
+	return a.addFile(target, filePath, name)
+}
+
+func (a *archiver) addDir(relativePath string, name string, stat os.FileInfo) error {
+	if name != "" {
+		a.added[name] = true
+		if err := a.archive.addDir(name, stat); err != nil {
+			return err
+		}
+	}
+
+	entries, err := readMergedDir(a.drive.Roots(), relativePath)
+	if err == info.ErrUnresponsive {
+		return err
+	} else if err != nil {
+		a.skip(name, err)
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.Name()[0:1] == "." && !a.hidden {
+			continue
+		}
+		if err := a.add(filepath.Join(relativePath, entry.Name()), path.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFile copies one file into the archive. The file is registered like downloads, so ejects wait for it
+// or close it, and read with the volume deadline, so a volume that hangs aborts the archive.
+func (a *archiver) addFile(target *info.Drive, filePath string, name string) error {
+	var file *os.File
+	var stat os.FileInfo
+	err := info.Guard(target.Path, func() (err error) {
+		file, err = os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		stat, err = file.Stat()
+		if err != nil {
+			_ = file.Close()
+		}
+		return err
+	})
+	if err == info.ErrUnresponsive {
+		return err
+	} else if err != nil {
+		a.skip(name, err)
+		return nil
+	}
+	if err := beginDownload(target, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	defer endDownload(target.Id, file)
+
+	return a.archive.addFile(name, stat, info.ContextReader(a.ctx, info.GuardReader(target.Path, file)))
+}
+
+// skip records an entry that couldn't be read into the archive.
+func (a *archiver) skip(name string, err error) {
+	if name == "" {
+		name = "/"
+	}
+	log.Printf("Skipping %s in archive of %s: %v", name, a.drive.Id, err)
+	a.skipped = append(a.skipped, name+": "+err.Error())
+}
+
+// addErrors adds the list of skipped entries at the end of the archive, if anything was skipped. A file of
+// the same name at the archive root keeps its name, the list then gets a numbered one.
+func (a *archiver) addErrors() error {
+	if len(a.skipped) == 0 {
+		return nil
+	}
+	name := archiveErrorsName
+	for i := 1; a.added[name]; i++ {
+		name = strings.TrimSuffix(archiveErrorsName, ".txt") + "-" + strconv.Itoa(i) + ".txt"
+	}
+	a.added[name] = true
+
+	content := "These entries couldn't be read and are missing from the archive:\n" + strings.Join(a.skipped, "\n") + "\n"
+	stat := archiveNoteInfo{name: name, size: int64(len(content)), modTime: time.Now()}
+	return a.archive.addFile(name, stat, strings.NewReader(content))
+}
+
+// archiveNoteInfo describes an archive entry that isn't on the volume.
+type archiveNoteInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (n archiveNoteInfo) Name() string       { return n.name }
+func (n archiveNoteInfo) Size() int64        { return n.size }
+func (n archiveNoteInfo) Mode() os.FileMode  { return 0644 }
+func (n archiveNoteInfo) ModTime() time.Time { return n.modTime }
+func (n archiveNoteInfo) IsDir() bool        { return false }
+func (n archiveNoteInfo) Sys() interface{}   { return nil }
+
+// abort ends the response without finishing the archive.
+func (a *archiver) abort(err error) {
+	if a.ctx.Err() == nil {
+		log.Printf("Archive of %s failed: %v", a.drive.Id, err)
+	}
+	panic(http.ErrAbortHandler)
+}
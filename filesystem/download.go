@@ -0,0 +1,174 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"guptaspi/info"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// openFiles holds the files being downloaded from each drive, so ejects can wait for or close them.
+// It is guarded by downloadsLock.
+var openFiles = map[string]map[*os.File]bool{}
+var downloadsLock = sync.Mutex{}
+
+// downloadFile streams the file at path on the volume. Ranges and conditional requests are handled by
+// http.ServeContent, which sends whole files and single ranges with sendfile.
+func downloadFile(w http.ResponseWriter, r *http.Request) {
+	volume := mux.Vars(r)["volume"]
+
+	relativePath := filepath.Clean("/" + r.FormValue("path"))
+	if relativePath == string(filepath.Separator) {
+		w.WriteHeader(400)
+		return
+	}
+	attachment := false
+	if value := r.FormValue("download"); value != "" {
+		var err error
+		attachment, err = strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Download query param error, %v", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	drive := info.GetDrive(volume)
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if err := drive.CheckAvailable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+
+	target, filePath := drive.LocateDrive(relativePath)
+	var file *os.File
+	var stat os.FileInfo
+	err := info.Guard(target.Path, func() (err error) {
+		file, err = os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		stat, err = file.Stat()
+		if err != nil {
+			_ = file.Close()
+		}
+		return err
+	})
+	if os.IsNotExist(err) {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		log.Printf("Error opening file for download: %v", err)
+		w.WriteHeader(info.ErrorStatus(err))
+		return
+	}
+	if err := beginDownload(target, file); err != nil {
+		_ = file.Close()
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+	defer endDownload(target.Id, file)
+
+	if stat.IsDir() {
+		w.WriteHeader(400)
+		return
+	}
+
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": stat.Name()}))
+	w.Header().Set("ETag", fileETag(stat))
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+}
+
+// fileETag derives a strong ETag from the size and modification time, so it needs no read of the content.
+// Strong is what If-Range requires, and a file rewritten within the same nanosecond at the same size is unlikely.
+func fileETag(stat os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size())
+}
+
+// beginDownload registers a file being downloaded from the drive. It fails while the drive is ejecting or
+// unresponsive, which is checked under downloadsLock so drainDownloads can't miss the file.
+func beginDownload(drive *info.Drive, file *os.File) error {
+	downloadsLock.Lock()
+	defer downloadsLock.Unlock()
+	if err := drive.CheckAvailable(); err != nil {
+		return err
+	}
+	files, ok := openFiles[drive.Id]
+	if !ok {
+		files = map[*os.File]bool{}
+		openFiles[drive.Id] = files
+	}
+	files[file] = true
+	return nil
+}
+
+// endDownload closes the file, unless an eject closed it already.
+func endDownload(driveId string, file *os.File) {
+	downloadsLock.Lock()
+	files := openFiles[driveId]
+	open := files[file]
+	delete(files, file)
+	if len(files) == 0 {
+		delete(openFiles, driveId)
+	}
+	downloadsLock.Unlock()
+
+	if open {
+		if err := file.Close(); err != nil {
+			log.Printf("Failed to close file: %v", err)
+		}
+	}
+}
+
+// drainDownloads is called when a volume is ejected. It waits until every download from the volume finished,
+// or with cancel closes their files, which ends the responses early.
+func drainDownloads(ctx context.Context, volume string, cancel bool) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		var closed []*os.File
+		downloadsLock.Lock()
+		files := openFiles[volume]
+		pending := len(files)
+		if cancel {
+			for file, open := range files {
+				if open {
+					closed = append(closed, file)
+					files[file] = false
+				}
+			}
+		}
+		downloadsLock.Unlock()
+
+		for _, file := range closed {
+			log.Printf("Cancelled download of %s for eject", file.Name())
+			_ = file.Close()
+		}
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d downloads still in progress: %w", pending, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strconv"
 )
@@ -18,6 +19,13 @@ type GetFolderChildrenReturn struct {
 
 func AddFileSystemRouter(r *mux.Router) {
 	r.HandleFunc("/filesystem/{volume}", getFolderChildren).Methods("GET")
+	r.HandleFunc("/filesystem/{volume}/usage", getUsage).Methods("GET")
+	r.HandleFunc("/filesystem/{volume}/usage", refreshUsage).Methods("POST")
+	r.HandleFunc("/filesystem/{volume}/file", downloadFile).Methods("GET", "HEAD")
+	r.HandleFunc("/filesystem/{volume}/archive", downloadArchive).Methods("GET")
+
+	info.AddEjectHandler(cancelUsageScan)
+	info.AddEjectHandler(drainDownloads)
 }
 
 func getFolderChildren(w http.ResponseWriter, r *http.Request) {
@@ -47,13 +55,15 @@ func getFolderChildren(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(404)
 		return
 	}
+	if err := drive.CheckAvailable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
 
-	dirPath = filepath.Join(drive.Path, dirPath)
-
-	files, err := ioutil.ReadDir(dirPath)
+	files, err := readMergedDir(drive.Roots(), dirPath)
 	if err != nil {
 		log.Printf("Error when reading path: %v", err)
-		w.WriteHeader(500)
+		w.WriteHeader(info.ErrorStatus(err))
 		return
 	}
 
@@ -65,3 +75,39 @@ func getFolderChildren(w http.ResponseWriter, r *http.Request) {
 		Files:       fi,
 	})
 }
+
+// readMergedDir lists dirPath under each root, which is a single one unless the volume is a pool.
+// Entries with the same name are listed once, from the first root having them.
+// Roots missing the folder or not responding are skipped, it's only an error if none has it.
+func readMergedDir(roots []string, dirPath string) ([]os.FileInfo, error) {
+	var merged []os.FileInfo
+	seen := map[string]bool{}
+	var firstErr error
+	found := false
+	for _, root := range roots {
+		var files []os.FileInfo
+		err := info.Guard(root, func() (err error) {
+			files, err = ioutil.ReadDir(filepath.Join(root, dirPath))
+			return err
+		})
+		if err != nil {
+			// The folder may be on a member that doesn't respond, so that's the error to report
+			if firstErr == nil || err == info.ErrUnresponsive {
+				firstErr = err
+			}
+			continue
+		}
+		found = true
+		for _, file := range files {
+			if seen[file.Name()] {
+				continue
+			}
+			seen[file.Name()] = true
+			merged = append(merged, file)
+		}
+	}
+	if !found {
+		return nil, firstErr
+	}
+	return merged, nil
+}
@@ -0,0 +1,460 @@
+package filesystem
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"guptaspi/info"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// largestFilesCount is how many of a volume's biggest files are kept per scan.
+const largestFilesCount = 50
+
+// usageMaxAge is how old a scan can get before reading it starts a new one in the background.
+var usageMaxAge = 24 * time.Hour
+
+// usageScanRate limits how many entries a scan visits per second, so USB disks stay usable while scanning.
+// Zero disables the limit.
+var usageScanRate = 2000
+
+// scanSlots lets one scan run at a time, the others queue behind it.
+var scanSlots = make(chan struct{}, 1)
+
+type UsageEntry struct {
+	Name        string `json:"name"`
+	Size        uint64 `json:"size"`
+	Files       uint64 `json:"files"`
+	Directories uint64 `json:"directories"`
+}
+
+type LargeFile struct {
+	Path  string    `json:"path"`
+	Size  uint64    `json:"size"`
+	MTime time.Time `json:"m_time"`
+}
+
+type ExtensionUsage struct {
+	Extension string `json:"extension"`
+	Size      uint64 `json:"size"`
+	Files     uint64 `json:"files"`
+}
+
+type VolumeUsage struct {
+	Volume       string           `json:"volume"`
+	Folder       string           `json:"folder"`
+	Scanning     bool             `json:"scanning"`
+	StartedAt    *time.Time       `json:"started_at,omitempty"`
+	ScannedAt    *time.Time       `json:"scanned_at,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Size         uint64           `json:"size"`
+	Files        uint64           `json:"files"`
+	Directories  uint64           `json:"directories"`
+	Children     []UsageEntry     `json:"children"`
+	LargestFiles []LargeFile      `json:"largest_files"`
+	Extensions   []ExtensionUsage `json:"extensions"`
+}
+
+// usageNode is a directory in a scanned usage tree. Sizes and counts include everything below it.
+type usageNode struct {
+	name        string
+	size        uint64
+	files       uint64
+	directories uint64
+	children    map[string]*usageNode
+}
+
+type usageScan struct {
+	root         *usageNode
+	largestFiles []LargeFile
+	extensions   map[string]*ExtensionUsage
+	startedAt    time.Time
+	finishedAt   time.Time
+	err          error
+}
+
+// volumeUsageState holds the latest finished scan of a volume and whether a new one is running.
+type volumeUsageState struct {
+	scan     *usageScan
+	scanning bool
+	started  time.Time
+	// cancel stops the running scan, done is closed once it stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var usageStates = map[string]*volumeUsageState{}
+var usageLock = sync.Mutex{}
+
+// UsageConfigFromEnv reads USAGE_MAX_AGE, a duration, and USAGE_SCAN_RATE, entries per second.
+func UsageConfigFromEnv() {
+	if value := os.Getenv("USAGE_MAX_AGE"); value != "" {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			log.Printf("Invalid USAGE_MAX_AGE %q, using %s", value, usageMaxAge)
+		} else {
+			usageMaxAge = d
+		}
+	}
+	if value := os.Getenv("USAGE_SCAN_RATE"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			log.Printf("Invalid USAGE_SCAN_RATE %q, using %d", value, usageScanRate)
+		} else {
+			usageScanRate = n
+		}
+	}
+}
+
+// startUsageScan scans the drive in the background unless a scan of it is already running.
+func startUsageScan(drive *info.Drive) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+
+	state, ok := usageStates[drive.Id]
+	if !ok {
+		state = &volumeUsageState{}
+		usageStates[drive.Id] = state
+	}
+	if state.scanning {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	state.scanning = true
+	state.started = time.Now().UTC()
+	state.cancel = cancel
+	state.done = make(chan struct{})
+
+	go func(done chan struct{}) {
+		defer close(done)
+		defer cancel()
+
+		var scan *usageScan
+		select {
+		case scanSlots <- struct{}{}:
+			scan = scanUsage(ctx, drive.Roots())
+			<-scanSlots
+		case <-ctx.Done():
+		}
+
+		usageLock.Lock()
+		// A cancelled scan is incomplete, the previous result is kept
+		if ctx.Err() == nil {
+			state.scan = scan
+		}
+		state.scanning = false
+		usageLock.Unlock()
+	}(state.done)
+}
+
+// cancelUsageScan is called when a volume is ejected. It stops a running scan of the volume and waits for it,
+// so the scan doesn't keep the volume busy.
+func cancelUsageScan(ctx context.Context, volume string, _ bool) error {
+	usageLock.Lock()
+	state, ok := usageStates[volume]
+	if !ok || !state.scanning {
+		usageLock.Unlock()
+		return nil
+	}
+	state.cancel()
+	done := state.done
+	usageLock.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scanUsage scans the roots of a volume, which are a single one unless it's a pool,
+// merging folders with the same path into one tree.
+func scanUsage(ctx context.Context, roots []string) *usageScan {
+	scan := &usageScan{
+		root:       &usageNode{},
+		extensions: map[string]*ExtensionUsage{},
+		startedAt:  time.Now().UTC(),
+	}
+	largest := &fileHeap{}
+
+	s := &scanner{ctx: ctx, scan: scan, largest: largest, windowStart: time.Now()}
+	scanned := 0
+	for _, root := range roots {
+		var rootInfo os.FileInfo
+		err := info.Guard(root, func() (err error) {
+			rootInfo, err = os.Lstat(root)
+			return err
+		})
+		if err != nil {
+			scan.err = err
+			continue
+		}
+		s.root = root
+		s.rootInfo = rootInfo
+		node := &usageNode{}
+		s.walk(node, root, "")
+		mergeUsage(scan.root, node)
+		scanned++
+	}
+	if scanned > 0 {
+		scan.err = nil
+	}
+
+	scan.largestFiles = make([]LargeFile, largest.Len())
+	for i := len(scan.largestFiles) - 1; i >= 0; i-- {
+		scan.largestFiles[i] = heap.Pop(largest).(LargeFile)
+	}
+	scan.finishedAt = time.Now().UTC()
+	log.Printf("Scanned usage of %s in %s", strings.Join(roots, ", "), scan.finishedAt.Sub(scan.startedAt))
+	return scan
+}
+
+// mergeUsage adds the tree of src to dst. A folder present in both is counted once.
+func mergeUsage(dst *usageNode, src *usageNode) {
+	dst.size += src.size
+	dst.files += src.files
+	for name, child := range src.children {
+		if dst.children == nil {
+			dst.children = map[string]*usageNode{}
+		}
+		existing, ok := dst.children[name]
+		if !ok {
+			dst.children[name] = child
+			dst.directories += child.directories + 1
+			continue
+		}
+		before := existing.directories
+		mergeUsage(existing, child)
+		dst.directories += existing.directories - before
+	}
+}
+
+type scanner struct {
+	ctx         context.Context
+	root        string
+	rootInfo    os.FileInfo
+	scan        *usageScan
+	largest     *fileHeap
+	visited     int
+	windowStart time.Time
+}
+
+// throttle sleeps whenever the scan gets ahead of usageScanRate.
+func (s *scanner) throttle() {
+	if usageScanRate == 0 {
+		return
+	}
+	s.visited++
+	if s.visited < usageScanRate/10+1 {
+		return
+	}
+	expected := time.Duration(s.visited) * time.Second / time.Duration(usageScanRate)
+	if elapsed := time.Since(s.windowStart); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+	s.visited = 0
+	s.windowStart = time.Now()
+}
+
+// walk fills node with the usage below dirPath. Symlinks aren't followed and other filesystems mounted inside
+// the volume are skipped, so nothing is counted twice.
+func (s *scanner) walk(node *usageNode, dirPath string, relativePath string) {
+	var entries []os.FileInfo
+	err := info.Guard(s.root, func() (err error) {
+		entries, err = ioutil.ReadDir(dirPath)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error reading %s for usage: %v", dirPath, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.throttle()
+
+		if entry.IsDir() {
+			if !sameDevice(s.rootInfo, entry) {
+				continue
+			}
+			child := &usageNode{name: entry.Name()}
+			s.walk(child, filepath.Join(dirPath, entry.Name()), filepath.Join(relativePath, entry.Name()))
+			if node.children == nil {
+				node.children = map[string]*usageNode{}
+			}
+			node.children[child.name] = child
+			node.size += child.size
+			node.files += child.files
+			node.directories += child.directories + 1
+			continue
+		}
+
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		size := uint64(entry.Size())
+		node.size += size
+		node.files++
+
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		extension, ok := s.scan.extensions[ext]
+		if !ok {
+			extension = &ExtensionUsage{Extension: ext}
+			s.scan.extensions[ext] = extension
+		}
+		extension.Size += size
+		extension.Files++
+
+		if s.largest.Len() < largestFilesCount || size > (*s.largest)[0].Size {
+			heap.Push(s.largest, LargeFile{
+				Path:  filepath.ToSlash(filepath.Join(relativePath, entry.Name())),
+				Size:  size,
+				MTime: entry.ModTime(),
+			})
+			if s.largest.Len() > largestFilesCount {
+				heap.Pop(s.largest)
+			}
+		}
+	}
+}
+
+// fileHeap is a min-heap on size, so the smallest of the largest files is the one dropped.
+type fileHeap []LargeFile
+
+func (h fileHeap) Len() int            { return len(h) }
+func (h fileHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h fileHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileHeap) Push(x interface{}) { *h = append(*h, x.(LargeFile)) }
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// getUsage returns one level of the volume's usage tree at folder, starting a scan if there is none yet
+// or the last one is older than usageMaxAge. The largest files and extensions cover the whole volume.
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	volume := mux.Vars(r)["volume"]
+
+	drive := info.GetDrive(volume)
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if err := drive.CheckAvailable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+
+	usageLock.Lock()
+	state := usageStates[drive.Id]
+	var scan *usageScan
+	if state != nil {
+		scan = state.scan
+	}
+	usageLock.Unlock()
+
+	if scan == nil || time.Since(scan.finishedAt) > usageMaxAge {
+		startUsageScan(drive)
+	}
+
+	usageLock.Lock()
+	state = usageStates[drive.Id]
+	response := VolumeUsage{
+		Volume:   drive.Id,
+		Folder:   r.FormValue("folder"),
+		Scanning: state.scanning,
+	}
+	if state.scanning {
+		started := state.started
+		response.StartedAt = &started
+	}
+	usageLock.Unlock()
+
+	if scan == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		_ = json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response.ScannedAt = &scan.finishedAt
+	if scan.err != nil {
+		response.Error = scan.err.Error()
+	}
+
+	node := scan.root
+	for _, name := range strings.Split(filepath.ToSlash(filepath.Clean("/"+response.Folder)), "/") {
+		if name == "" {
+			continue
+		}
+		node = node.children[name]
+		if node == nil {
+			w.WriteHeader(404)
+			return
+		}
+	}
+
+	response.Size = node.size
+	response.Files = node.files
+	response.Directories = node.directories
+	response.Children = make([]UsageEntry, 0, len(node.children))
+	for _, child := range node.children {
+		response.Children = append(response.Children, UsageEntry{
+			Name:        child.name,
+			Size:        child.size,
+			Files:       child.files,
+			Directories: child.directories,
+		})
+	}
+	sort.Slice(response.Children, func(i, j int) bool {
+		if response.Children[i].Size != response.Children[j].Size {
+			return response.Children[i].Size > response.Children[j].Size
+		}
+		return response.Children[i].Name < response.Children[j].Name
+	})
+
+	response.LargestFiles = scan.largestFiles
+	response.Extensions = make([]ExtensionUsage, 0, len(scan.extensions))
+	for _, extension := range scan.extensions {
+		response.Extensions = append(response.Extensions, *extension)
+	}
+	sort.Slice(response.Extensions, func(i, j int) bool {
+		if response.Extensions[i].Size != response.Extensions[j].Size {
+			return response.Extensions[i].Size > response.Extensions[j].Size
+		}
+		return response.Extensions[i].Extension < response.Extensions[j].Extension
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// refreshUsage starts a new scan of the volume. The previous result is served until it finishes.
+func refreshUsage(w http.ResponseWriter, r *http.Request) {
+	drive := info.GetDrive(mux.Vars(r)["volume"])
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if err := drive.CheckAvailable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+
+	startUsageScan(drive)
+	w.WriteHeader(202)
+}
@@ -0,0 +1,15 @@
+// +build linux
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+)
+
+// sameDevice reports whether both files are on the same filesystem.
+func sameDevice(a os.FileInfo, b os.FileInfo) bool {
+	statA, okA := a.Sys().(*syscall.Stat_t)
+	statB, okB := b.Sys().(*syscall.Stat_t)
+	return !okA || !okB || statA.Dev == statB.Dev
+}
@@ -0,0 +1,383 @@
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"guptaspi/info"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexSaveInterval is after how many copied files the index is saved during a job, besides at its end.
+const indexSaveInterval = 20
+
+// importIndexFile is where the hashes of imported files are persisted. Empty keeps them in memory only.
+var importIndexFile string
+
+// importIndex maps the SHA-256 of every imported file to where it was copied, as volume/path.
+// It is loaded on the first import and guarded by indexLock.
+var importIndex map[string]string
+var indexLock = sync.Mutex{}
+
+// SetIndexFile sets the file the hashes of imported files are loaded from and saved to.
+func SetIndexFile(path string) {
+	indexLock.Lock()
+	importIndexFile = path
+	importIndex = nil
+	indexLock.Unlock()
+}
+
+// IndexFileFromEnv reads IMPORT_INDEX_FILE, defaulting to import_index.json in the working directory.
+func IndexFileFromEnv() string {
+	if value, ok := os.LookupEnv("IMPORT_INDEX_FILE"); ok {
+		return value
+	}
+	return "import_index.json"
+}
+
+// loadIndex reads importIndex unless it's loaded already. It must be called with indexLock held.
+func loadIndex() {
+	if importIndex != nil {
+		return
+	}
+	importIndex = map[string]string{}
+	if importIndexFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(importIndexFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Error reading import index: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, &importIndex); err != nil {
+		log.Printf("Error parsing import index %s: %v", importIndexFile, err)
+		importIndex = map[string]string{}
+	}
+}
+
+// saveIndex writes importIndex atomically. It must be called with indexLock held.
+func saveIndex() {
+	if importIndexFile == "" {
+		return
+	}
+	data, err := json.Marshal(importIndex)
+	if err != nil {
+		log.Printf("Error encoding import index: %v", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(importIndexFile), filepath.Base(importIndexFile)+".*")
+	if err != nil {
+		log.Printf("Error saving import index: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), importIndexFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		log.Printf("Error saving import index: %v", err)
+	}
+}
+
+// sourceFile is a file found on the source, relative to its root
+type sourceFile struct {
+	path  string
+	size  uint64
+	mtime time.Time
+}
+
+// runJob copies the new files of the source to the destination. The index is saved every indexSaveInterval
+// copied files and once the job ends, so an import interrupted even by a crash copies little again.
+func runJob(ctx context.Context, job *Job, source *info.Drive) {
+	root := source.Path
+	if job.rule.DCIM {
+		root = filepath.Join(root, "DCIM")
+	}
+
+	files, err := listSourceFiles(ctx, root)
+	if err != nil {
+		finishJob(job, JobFailed, err)
+		return
+	}
+	lock.Lock()
+	job.TotalFiles = len(files)
+	for _, file := range files {
+		job.TotalBytes += file.size
+	}
+	lock.Unlock()
+	log.Printf("Importing %d files from %s to %s", len(files), source.VolumeLabel, job.Destination)
+
+	indexLock.Lock()
+	loadIndex()
+	indexLock.Unlock()
+	defer func() {
+		indexLock.Lock()
+		saveIndex()
+		indexLock.Unlock()
+	}()
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			finishJob(job, JobCancelled, nil)
+			return
+		}
+
+		destination := info.GetDrive(job.Destination)
+		if destination == nil {
+			finishJob(job, JobFailed, fmt.Errorf("destination %s is not available", job.Destination))
+			return
+		}
+		// Ejecting either side stops the import between files
+		if err := source.CheckAvailable(); err != nil {
+			finishJob(job, JobCancelled, err)
+			return
+		}
+		if err := destination.CheckWritable(); err != nil {
+			finishJob(job, JobFailed, err)
+			return
+		}
+		lock.Lock()
+		job.drives[destination.Id] = true
+		lock.Unlock()
+
+		outcome, size, err := importFile(ctx, job, source.Path, filepath.Join(root, file.path), file, destination)
+		if outcome == "failed" && ctx.Err() != nil {
+			// Cancelled while copying, the loop ends on the next round
+			continue
+		}
+		if err == errOutsideVolume {
+			finishJob(job, JobFailed, err)
+			return
+		}
+		importedFilesCounter.Inc(outcome)
+		lock.Lock()
+		switch outcome {
+		case "copied":
+			job.Copied++
+			job.CopiedBytes += size
+		case "skipped":
+			job.Skipped++
+		default:
+			job.Failed++
+			job.addError(fmt.Errorf("%s: %v", file.path, err))
+		}
+		save := outcome == "copied" && job.Copied%indexSaveInterval == 0
+		lock.Unlock()
+
+		if save {
+			indexLock.Lock()
+			saveIndex()
+			indexLock.Unlock()
+		}
+	}
+
+	if ctx.Err() != nil {
+		finishJob(job, JobCancelled, nil)
+		return
+	}
+	lock.Lock()
+	failed := job.Failed > 0
+	lock.Unlock()
+	if failed {
+		finishJob(job, JobFailed, nil)
+		return
+	}
+	finishJob(job, JobFinished, nil)
+
+	if job.rule.Eject {
+		if _, err := info.Eject(source, false, ejectTimeout); err != nil {
+			lock.Lock()
+			job.addError(fmt.Errorf("eject: %v", err))
+			lock.Unlock()
+			return
+		}
+		lock.Lock()
+		job.Ejected = true
+		lock.Unlock()
+	}
+}
+
+// listSourceFiles returns the regular files below root, skipping hidden ones like .Trashes on cameras.
+func listSourceFiles(ctx context.Context, root string) ([]sourceFile, error) {
+	var files []sourceFile
+	err := filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if path != root && strings.HasPrefix(fileInfo.Name(), ".") {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, sourceFile{path: relativePath, size: uint64(fileInfo.Size()), mtime: fileInfo.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// importFile copies one file unless its content was imported before. It returns copied, skipped or failed.
+// Reads from the source run with the deadline of sourceRoot's volume, so a dying card fails the file instead of
+// hanging the job.
+func importFile(ctx context.Context, job *Job, sourceRoot string, sourcePath string, file sourceFile, destination *info.Drive) (string, uint64, error) {
+	hash, err := hashFile(ctx, sourceRoot, sourcePath)
+	if err != nil {
+		return "failed", 0, err
+	}
+
+	indexLock.Lock()
+	_, known := importIndex[hash]
+	indexLock.Unlock()
+	if known {
+		return "skipped", 0, nil
+	}
+
+	folder := expandFolder(job.rule.Folder, job.rule, job.SourceLabel, file.mtime)
+	relativePath, err := freePath(destination, filepath.Join(folder, filepath.Base(file.path)))
+	if err != nil {
+		return "failed", 0, err
+	}
+	if !insideVolume(destination, relativePath) {
+		return "failed", 0, errOutsideVolume
+	}
+	target, err := destination.PlaceFile(relativePath, file.size)
+	if err != nil {
+		return "failed", 0, err
+	}
+	lock.Lock()
+	job.drives[target.Id] = true
+	lock.Unlock()
+
+	if err := copyFile(ctx, sourceRoot, sourcePath, filepath.Join(target.Path, relativePath), file.mtime); err != nil {
+		return "failed", 0, err
+	}
+
+	indexLock.Lock()
+	importIndex[hash] = destination.Id + "/" + filepath.ToSlash(relativePath)
+	indexLock.Unlock()
+	return "copied", file.size, nil
+}
+
+// freePath returns relativePath, or the first of name-1.ext, name-2.ext and so on that doesn't exist on the volume.
+// Different files with the same name are common, cameras restart their numbering.
+func freePath(drive *info.Drive, relativePath string) (string, error) {
+	ext := filepath.Ext(relativePath)
+	base := strings.TrimSuffix(relativePath, ext)
+	candidate := relativePath
+	for i := 1; i <= 1000; i++ {
+		if _, err := os.Lstat(drive.Locate(candidate)); os.IsNotExist(err) {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return "", fmt.Errorf("no free name for %s", relativePath)
+}
+
+func hashFile(ctx context.Context, root string, path string) (string, error) {
+	file, err := openSource(root, path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, info.ContextReader(ctx, info.GuardReader(root, file))); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyFile copies through a temporary file next to the target, so a cancelled or failed copy leaves nothing
+// under the final name. The modification time is kept for the date folders of later imports.
+func copyFile(ctx context.Context, sourceRoot string, sourcePath string, targetPath string, mtime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0777); err != nil {
+		return err
+	}
+
+	source, err := openSource(sourceRoot, sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, info.ContextReader(ctx, info.GuardReader(sourceRoot, source)))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), targetPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// openSource opens a file on the source with the volume deadline of root.
+func openSource(root string, path string) (*os.File, error) {
+	var file *os.File
+	err := info.Guard(root, func() (err error) {
+		file, err = os.Open(path)
+		return err
+	})
+	if err == info.ErrUnresponsive {
+		return nil, err
+	}
+	return file, err
+}
+
+// finishJob records the end of a job.
+func finishJob(job *Job, state string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	job.State = state
+	if err != nil {
+		job.addError(err)
+	}
+	now := time.Now().UTC()
+	job.Finished = &now
+	log.Printf("Import from %s %s: %d copied, %d skipped, %d failed",
+		job.SourceLabel, state, job.Copied, job.Skipped, job.Failed)
+}
+
+// addError records an error of the job. It must be called with lock held.
+func (j *Job) addError(err error) {
+	if len(j.Errors) < maxJobErrors {
+		j.Errors = append(j.Errors, err.Error())
+	}
+}
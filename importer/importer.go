@@ -0,0 +1,448 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"guptaspi/auth"
+	"guptaspi/info"
+	"guptaspi/metrics"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JobRunning   = "running"
+	JobFinished  = "finished"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// defaultFolder sorts imported files into a folder per day
+const defaultFolder = "Imports/{yyyy}/{yyyy}-{mm}-{dd}"
+
+// keptJobs is how many finished jobs are remembered for the endpoints
+const keptJobs = 50
+
+// maxJobErrors limits the errors kept per job, the counts include all of them
+const maxJobErrors = 20
+
+// ejectTimeout is how long the eject after an import waits for other work on the source
+const ejectTimeout = time.Minute
+
+// Rule decides which drives are imported and where their files go.
+// Label and Uuid are globs in the syntax of path.Match, a rule needs at least one of Label, Uuid and DCIM.
+type Rule struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Uuid  string `json:"uuid"`
+	// DCIM requires a DCIM folder at the root of the drive, which is then the only folder imported
+	DCIM bool `json:"dcim"`
+	// Destination is the Id or label of the volume files are copied to
+	Destination string `json:"destination"`
+	// Folder is where files go on the destination. {yyyy}, {mm} and {dd} are replaced by the file's modification date,
+	// {label} by the source's volume label and {rule} by the rule's name.
+	Folder string `json:"folder"`
+	// Eject unmounts the source once the import finished without errors
+	Eject bool `json:"eject"`
+}
+
+// Job reports the progress of an import.
+type Job struct {
+	Id          string     `json:"id"`
+	Rule        string     `json:"rule"`
+	Source      string     `json:"source"`
+	SourceLabel string     `json:"source_label"`
+	Destination string     `json:"destination"`
+	State       string     `json:"state"`
+	TotalFiles  int        `json:"total_files"`
+	TotalBytes  uint64     `json:"total_bytes"`
+	Copied      int        `json:"copied"`
+	CopiedBytes uint64     `json:"copied_bytes"`
+	Skipped     int        `json:"skipped"`
+	Failed      int        `json:"failed"`
+	Errors      []string   `json:"errors"`
+	Ejected     bool       `json:"ejected"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+
+	rule Rule
+	// drives are the Ids of the source and of the drives written to, an eject of any of them stops the job
+	drives map[string]bool
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var rules []Rule
+
+// jobs holds the running and the latest finished jobs by Id. It is guarded by lock, like the fields of the jobs.
+var jobs = map[string]*Job{}
+var lock = sync.Mutex{}
+
+var importedFilesCounter = metrics.NewCounter(
+	"guptaspi_import_files_total", "Files handled by imports from inserted drives.", "outcome",
+)
+
+// SetRules replaces the import rules. Invalid rules are logged and left out.
+func SetRules(r []Rule) {
+	var valid []Rule
+	for _, rule := range r {
+		if err := rule.Validate(); err != nil {
+			log.Printf("Ignoring import rule %q: %v", rule.Name, err)
+			continue
+		}
+		valid = append(valid, rule)
+	}
+	lock.Lock()
+	rules = valid
+	lock.Unlock()
+}
+
+// RulesFromEnv reads IMPORT_RULES, a JSON array of rules. No rules disables automatic imports.
+func RulesFromEnv() []Rule {
+	value := os.Getenv("IMPORT_RULES")
+	if value == "" {
+		return nil
+	}
+	var r []Rule
+	if err := json.Unmarshal([]byte(value), &r); err != nil {
+		log.Printf("Invalid IMPORT_RULES: %v", err)
+		return nil
+	}
+	return r
+}
+
+// Validate checks that the rule can't match every drive and has a destination.
+func (r Rule) Validate() error {
+	if r.Label == "" && r.Uuid == "" && !r.DCIM {
+		return errors.New("a label, uuid or dcim is required")
+	}
+	for _, pattern := range []string{r.Label, r.Uuid} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	if r.Destination == "" {
+		return errors.New("destination is required")
+	}
+	return nil
+}
+
+// Match reports whether the rule applies to the drive. The destination itself never matches.
+func (r Rule) Match(drive *info.Drive) bool {
+	if drive.Kind != info.VolumeKindDrive || r.Destination == drive.Id || r.Destination == drive.VolumeLabel {
+		return false
+	}
+	if ok, _ := path.Match(r.Label, drive.VolumeLabel); r.Label != "" && !ok {
+		return false
+	}
+	if ok, _ := path.Match(r.Uuid, drive.Uuid); r.Uuid != "" && !ok {
+		return false
+	}
+	if r.DCIM {
+		stat, err := os.Stat(filepath.Join(drive.Path, "DCIM"))
+		if err != nil || !stat.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// AddImportRouter installs the import endpoints and starts importing newly inserted drives.
+func AddImportRouter(r *mux.Router) {
+	r.HandleFunc("/import", listJobs).Methods("GET")
+	r.Handle("/import/{volume}", auth.AdminOnly(http.HandlerFunc(startImport))).Methods("POST")
+	r.HandleFunc("/import/{id}", getJob).Methods("GET")
+	r.Handle("/import/{id}", auth.AdminOnly(http.HandlerFunc(cancelJob))).Methods("DELETE")
+
+	info.AddEjectHandler(stopImports)
+
+	go watchInserts(context.TODO())
+}
+
+// watchInserts starts an import for every drive that appears and matches a rule, until ctx is done.
+func watchInserts(ctx context.Context) {
+	events := info.Subscribe()
+	defer info.Unsubscribe(events)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Type != info.EventDriveAdded {
+				continue
+			}
+			if rule, ok := matchRule(event.Drive); ok {
+				log.Printf("Drive %s matches import rule %q", event.Drive.VolumeLabel, rule.Name)
+				if _, err := startJob(event.Drive, rule); err != nil {
+					log.Printf("Error starting import from %s: %v", event.Drive.VolumeLabel, err)
+				}
+			}
+		}
+	}
+}
+
+// matchRule returns the first rule applying to the drive.
+func matchRule(drive *info.Drive) (Rule, bool) {
+	lock.Lock()
+	r := rules
+	lock.Unlock()
+	for _, rule := range r {
+		if rule.Match(drive) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+var errImportRunning = errors.New("an import from this volume is running")
+
+// errOutsideVolume fails a job whose folder leads out of the destination volume
+var errOutsideVolume = errors.New("the import folder is outside the destination volume")
+
+// startJob imports the drive in the background. Only one import per source runs at a time.
+func startJob(drive *info.Drive, rule Rule) (Job, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return Job{}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		Id:          id.String(),
+		Rule:        rule.Name,
+		Source:      drive.Id,
+		SourceLabel: drive.VolumeLabel,
+		Destination: rule.Destination,
+		State:       JobRunning,
+		Errors:      []string{},
+		Started:     time.Now().UTC(),
+		rule:        rule,
+		drives:      map[string]bool{drive.Id: true},
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+
+	lock.Lock()
+	for _, other := range jobs {
+		if other.Source == drive.Id && other.State == JobRunning {
+			lock.Unlock()
+			cancel()
+			return Job{}, errImportRunning
+		}
+	}
+	jobs[job.Id] = job
+	pruneJobs()
+	response := *job
+	lock.Unlock()
+
+	go func() {
+		defer close(job.done)
+		defer cancel()
+		runJob(ctx, job, drive)
+	}()
+
+	return response, nil
+}
+
+// pruneJobs forgets the oldest finished jobs beyond keptJobs. It must be called with lock held.
+func pruneJobs() {
+	var finished []*Job
+	for _, job := range jobs {
+		if job.State != JobRunning {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= keptJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Started.Before(finished[j].Started) })
+	for _, job := range finished[:len(finished)-keptJobs] {
+		delete(jobs, job.Id)
+	}
+}
+
+// stopImports is called when a volume is ejected. Imports from or to it stop after the file they are copying,
+// or right away with cancel, removing the partial copy.
+func stopImports(ctx context.Context, volume string, cancel bool) error {
+	var waiting []*Job
+	lock.Lock()
+	for _, job := range jobs {
+		if job.State == JobRunning && job.drives[volume] {
+			if cancel {
+				job.cancel()
+			}
+			waiting = append(waiting, job)
+		}
+	}
+	lock.Unlock()
+
+	for _, job := range waiting {
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// listJobs corresponds to the GET /import endpoint.
+// This endpoint returns the running and recently finished imports, newest first.
+func listJobs(w http.ResponseWriter, _ *http.Request) {
+	lock.Lock()
+	list := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job.snapshot())
+	}
+	lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// startImport corresponds to the POST /import/{volume} endpoint.
+// It imports a drive that is already mounted, by the rule given in the rule query param or the first matching one.
+func startImport(w http.ResponseWriter, r *http.Request) {
+	drive := info.GetDrive(mux.Vars(r)["volume"])
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if err := drive.CheckAvailable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+
+	var rule Rule
+	var ok bool
+	if name := r.FormValue("rule"); name != "" {
+		lock.Lock()
+		for _, candidate := range rules {
+			if candidate.Name == name {
+				rule, ok = candidate, true
+			}
+		}
+		lock.Unlock()
+		if ok && !rule.Match(drive) {
+			http.Error(w, "the rule doesn't apply to the volume", 409)
+			return
+		}
+	} else {
+		rule, ok = matchRule(drive)
+	}
+	if !ok {
+		http.Error(w, "no import rule applies to the volume", 404)
+		return
+	}
+
+	job, err := startJob(drive, rule)
+	if err == errImportRunning {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
+		log.Printf("Error starting import: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// getJob corresponds to the GET /import/{id} endpoint.
+func getJob(w http.ResponseWriter, r *http.Request) {
+	lock.Lock()
+	job, ok := jobs[mux.Vars(r)["id"]]
+	var response Job
+	if ok {
+		response = job.snapshot()
+	}
+	lock.Unlock()
+
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// cancelJob corresponds to the DELETE /import/{id} endpoint.
+// The file being copied is removed, files copied before stay. It returns once the job stopped.
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	lock.Lock()
+	job, ok := jobs[mux.Vars(r)["id"]]
+	running := ok && job.State == JobRunning
+	if running {
+		job.cancel()
+	}
+	lock.Unlock()
+
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	if !running {
+		http.Error(w, "the import already finished", 409)
+		return
+	}
+
+	<-job.done
+	w.WriteHeader(204)
+}
+
+// snapshot copies the job for encoding. It must be called with lock held.
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Errors = append([]string{}, j.Errors...)
+	return c
+}
+
+// expandFolder fills in the placeholders of a rule's folder.
+func expandFolder(folder string, rule Rule, label string, date time.Time) string {
+	if folder == "" {
+		folder = defaultFolder
+	}
+	return strings.NewReplacer(
+		"{yyyy}", date.Format("2006"),
+		"{mm}", date.Format("01"),
+		"{dd}", date.Format("02"),
+		"{label}", placeholderValue(label),
+		"{rule}", placeholderValue(rule.Name),
+	).Replace(folder)
+}
+
+// placeholderValue makes a value part of a single folder name. Labels are chosen by whoever formatted the card,
+// one like ../../root must not move the import out of the destination.
+func placeholderValue(value string) string {
+	value = strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+	for strings.Contains(value, "..") {
+		value = strings.Replace(value, "..", "", -1)
+	}
+	return value
+}
+
+// insideVolume reports whether relativePath stays below the roots of drive, all of the members on pools.
+func insideVolume(drive *info.Drive, relativePath string) bool {
+	for _, root := range drive.Roots() {
+		rel, err := filepath.Rel(root, filepath.Join(root, relativePath))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package importer
+
+import (
+	"guptaspi/info"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandFolderHostileLabel(t *testing.T) {
+	date := time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		label  string
+		folder string
+	}{
+		{"EOS_DIGITAL", "Imports/EOS_DIGITAL/2024"},
+		{"../../../root/.ssh", "Imports/___root_.ssh/2024"},
+		{"..", "Imports/2024"},
+		{`..\..\Windows`, "Imports/__Windows/2024"},
+		{"....//", "Imports/__/2024"},
+	}
+	for _, test := range tests {
+		folder := expandFolder("Imports/{label}/{yyyy}", Rule{}, test.label, date)
+		relativePath := filepath.Join(folder, "IMG_0001.JPG")
+		if filepath.ToSlash(filepath.Dir(relativePath)) != test.folder {
+			t.Errorf("%q: got %s, want %s", test.label, filepath.Dir(relativePath), test.folder)
+		}
+		if !insideVolume(&info.Drive{Path: "/media/usb"}, relativePath) {
+			t.Errorf("%q: %s is outside the volume", test.label, relativePath)
+		}
+	}
+}
+
+func TestInsideVolume(t *testing.T) {
+	tests := []struct {
+		path   string
+		inside bool
+	}{
+		{"Imports/2024/IMG_0001.JPG", true},
+		{"Imports/../IMG_0001.JPG", true},
+		{"..data/IMG_0001.JPG", true},
+		{"../IMG_0001.JPG", false},
+		{"Imports/../../root/.ssh/authorized_keys", false},
+		{"..", false},
+	}
+	drive := &info.Drive{Path: filepath.FromSlash("/media/usb")}
+	for _, test := range tests {
+		if got := insideVolume(drive, filepath.FromSlash(test.path)); got != test.inside {
+			t.Errorf("%s: got %v", test.path, got)
+		}
+	}
+}
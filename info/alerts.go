@@ -0,0 +1,347 @@
+package info
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threshold is the free space below which a volume's alert fires. Free and Hysteresis are both
+// percentages of the volume size when Percent is set, otherwise bytes.
+type Threshold struct {
+	Free       float64
+	Percent    bool
+	Hysteresis float64
+}
+
+// VolumeAlert is the low space alert state of a volume, reported in /info.
+type VolumeAlert struct {
+	Firing    bool      `json:"firing"`
+	Threshold string    `json:"threshold"`
+	Since     time.Time `json:"since"`
+}
+
+const (
+	// AlertLowSpace alerts are about the free space of a volume
+	AlertLowSpace = "low-space"
+	// AlertDiskHealth alerts fire when the SMART health of a drive's disk degrades
+	AlertDiskHealth = "disk-health"
+)
+
+// Alert is sent to the sinks when a volume's alert fires or resolves. Warnings are only set for disk health alerts.
+type Alert struct {
+	Type               string    `json:"type"`
+	Volume             string    `json:"volume"`
+	VolumeLabel        string    `json:"volume_label"`
+	Path               string    `json:"path"`
+	Firing             bool      `json:"firing"`
+	Threshold          string    `json:"threshold"`
+	AvailableFreeSpace uint64    `json:"available_free_space"`
+	TotalSize          uint64    `json:"total_size"`
+	Warnings           []string  `json:"warnings,omitempty"`
+	Time               time.Time `json:"time"`
+}
+
+// AlertSink delivers alert notifications.
+type AlertSink interface {
+	Notify(alert Alert) error
+}
+
+type AlertConfig struct {
+	// Thresholds are keyed by volume Id, volume label or path. "*" applies to every other volume.
+	Thresholds map[string]Threshold
+	Interval   time.Duration
+	Sinks      []AlertSink
+}
+
+var alertConfig = AlertConfig{Interval: time.Minute}
+
+// alertStates holds the alert state by drive Id. It is guarded by lock, like driveMap.
+// States outlive their drives, so replugging a full drive doesn't notify again.
+var alertStates = map[string]*VolumeAlert{}
+
+// SetAlertConfig replaces the thresholds and sinks. Alerts are evaluated with them from the next interval on.
+func SetAlertConfig(config AlertConfig) {
+	lock.Lock()
+	alertConfig = config
+	lock.Unlock()
+}
+
+// AlertConfigFromEnv reads the alert configuration:
+// ALERT_THRESHOLDS is a comma separated list of volume=threshold, where the threshold is a percentage or a size
+// like 50GB, optionally followed by :hysteresis in the same unit. It defaults to *=10%.
+// ALERT_INTERVAL is how often the volumes are checked. Notifications always go to the log, and to a webhook
+// with ALERT_WEBHOOK_URL, or by email with ALERT_SMTP_ADDR, ALERT_SMTP_FROM and ALERT_SMTP_TO.
+func AlertConfigFromEnv() AlertConfig {
+	config := AlertConfig{
+		Thresholds: map[string]Threshold{},
+		Interval:   time.Minute,
+		Sinks:      []AlertSink{logSink{}},
+	}
+
+	thresholds := "*=10%"
+	if value, ok := os.LookupEnv("ALERT_THRESHOLDS"); ok {
+		thresholds = value
+	}
+	for _, item := range splitList(thresholds) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			log.Printf("Invalid ALERT_THRESHOLDS entry %q", item)
+			continue
+		}
+		threshold, err := ParseThreshold(item[i+1:])
+		if err != nil {
+			log.Printf("Invalid ALERT_THRESHOLDS entry %q: %v", item, err)
+			continue
+		}
+		config.Thresholds[strings.TrimSpace(item[:i])] = threshold
+	}
+
+	if value := os.Getenv("ALERT_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			log.Printf("Invalid ALERT_INTERVAL %q, using %s", value, config.Interval)
+		} else {
+			config.Interval = d
+		}
+	}
+
+	if url := os.Getenv("ALERT_WEBHOOK_URL"); url != "" {
+		config.Sinks = append(config.Sinks, newWebhookSink(url))
+	}
+
+	if addr := os.Getenv("ALERT_SMTP_ADDR"); addr != "" {
+		config.Sinks = append(config.Sinks, &smtpSink{
+			Addr:     addr,
+			Username: os.Getenv("ALERT_SMTP_USERNAME"),
+			Password: os.Getenv("ALERT_SMTP_PASSWORD"),
+			From:     os.Getenv("ALERT_SMTP_FROM"),
+			To:       splitList(os.Getenv("ALERT_SMTP_TO")),
+		})
+	}
+
+	return config
+}
+
+// ParseThreshold parses thresholds like "10%", "50GB" or "10%:2%". Without a hysteresis it is a tenth of the threshold.
+func ParseThreshold(s string) (Threshold, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+
+	free, percent, err := parseAmount(parts[0])
+	if err != nil {
+		return Threshold{}, err
+	}
+	if percent && free > 100 {
+		return Threshold{}, fmt.Errorf("percentage %q is over 100", parts[0])
+	}
+	threshold := Threshold{Free: free, Percent: percent, Hysteresis: free / 10}
+
+	if len(parts) == 2 {
+		hysteresis, hysteresisPercent, err := parseAmount(parts[1])
+		if err != nil {
+			return Threshold{}, err
+		}
+		if hysteresisPercent != percent {
+			return Threshold{}, fmt.Errorf("hysteresis %q must be in the same unit as the threshold", parts[1])
+		}
+		threshold.Hysteresis = hysteresis
+	}
+
+	return threshold, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// parseAmount parses a percentage or a size in bytes with an optional binary unit.
+func parseAmount(s string) (float64, bool, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if strings.HasSuffix(s, "%") {
+		value, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || value < 0 {
+			return 0, false, fmt.Errorf("invalid percentage %q", s)
+		}
+		return value, true, nil
+	}
+
+	factor := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, false, fmt.Errorf("invalid size %q", s)
+	}
+	return value * factor, false, nil
+}
+
+func (t Threshold) String() string {
+	if t.Percent {
+		return strconv.FormatFloat(t.Free, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatFloat(t.Free, 'f', 0, 64) + "B"
+}
+
+// bytes converts an amount in the threshold's unit to bytes of a volume of the given size.
+func (t Threshold) bytes(amount float64, total uint64) float64 {
+	if t.Percent {
+		return amount / 100 * float64(total)
+	}
+	return amount
+}
+
+// firing decides the next state from the free space, only resolving once the space is
+// Hysteresis above the threshold, so a volume hovering around it doesn't keep notifying.
+func (t Threshold) firing(wasFiring bool, available uint64, total uint64) bool {
+	free := float64(available)
+	if wasFiring {
+		return free < t.bytes(t.Free+t.Hysteresis, total)
+	}
+	return free < t.bytes(t.Free, total)
+}
+
+// thresholdFor finds the threshold configured for the drive. It must be called with lock held.
+func thresholdFor(drive *Drive) (Threshold, bool) {
+	for _, key := range []string{drive.Id, drive.VolumeLabel, drive.Path, "*"} {
+		if threshold, ok := alertConfig.Thresholds[key]; ok {
+			return threshold, true
+		}
+	}
+	return Threshold{}, false
+}
+
+// applyAlert sets the drive's alert state. It must be called with lock held.
+func applyAlert(drive *Drive) {
+	drive.Alert = alertStates[drive.Id]
+}
+
+// evaluateAlerts checks the free space of every drive against its threshold and notifies the sinks
+// of alerts that fired or resolved.
+func evaluateAlerts() {
+	for _, drive := range Drives() {
+		lock.RLock()
+		threshold, ok := thresholdFor(drive)
+		lock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		space, err := drive.diskSpace()
+		if err != nil {
+			continue
+		}
+		available, total := space[0], space[2]
+		if total == 0 {
+			continue
+		}
+
+		now := time.Now().UTC()
+		lock.Lock()
+		state := alertStates[drive.Id]
+		wasFiring := state != nil && state.Firing
+		firing := threshold.firing(wasFiring, available, total)
+		changed := state == nil || firing != wasFiring || state.Threshold != threshold.String()
+		if changed {
+			// States are replaced rather than updated, so drives being encoded never see a partial change
+			since := now
+			if state != nil && firing == wasFiring {
+				since = state.Since
+			}
+			alertStates[drive.Id] = &VolumeAlert{Firing: firing, Threshold: threshold.String(), Since: since}
+			updateDrive(drive.Id, applyAlert)
+		}
+		sinks := alertConfig.Sinks
+		lock.Unlock()
+
+		if firing == wasFiring {
+			continue
+		}
+
+		alert := Alert{
+			Type:               AlertLowSpace,
+			Volume:             drive.Id,
+			VolumeLabel:        drive.VolumeLabel,
+			Path:               drive.Path,
+			Firing:             firing,
+			Threshold:          threshold.String(),
+			AvailableFreeSpace: available,
+			TotalSize:          total,
+			Time:               now,
+		}
+		for _, sink := range sinks {
+			// Slow webhooks and mail servers mustn't hold up the other volumes
+			go func(sink AlertSink) {
+				if err := sink.Notify(alert); err != nil {
+					log.Printf("Error sending alert for %s: %v", alert.Volume, err)
+				}
+			}(sink)
+		}
+	}
+}
+
+// watchAlerts evaluates the alerts on the configured interval until ctx is done.
+func watchAlerts(ctx context.Context) {
+	for {
+		evaluateAlerts()
+
+		lock.RLock()
+		interval := alertConfig.Interval
+		lock.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping alert evaluation...")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Subject summarizes the alert for email subjects.
+func (a Alert) Subject() string {
+	switch {
+	case a.Type == AlertDiskHealth && a.Firing:
+		return "GuptasPi: the disk of volume " + a.VolumeLabel + " is degrading"
+	case a.Type == AlertDiskHealth:
+		return "GuptasPi: the disk of volume " + a.VolumeLabel + " has no SMART warnings anymore"
+	case a.Firing:
+		return "GuptasPi: volume " + a.VolumeLabel + " is low on space"
+	default:
+		return "GuptasPi: volume " + a.VolumeLabel + " has enough space again"
+	}
+}
+
+// Message describes the alert in a sentence, for the log and emails.
+func (a Alert) Message() string {
+	if a.Type == AlertDiskHealth {
+		if a.Firing {
+			return fmt.Sprintf("The disk of volume %s (%s) is degrading: %s",
+				a.VolumeLabel, a.Path, strings.Join(a.Warnings, "; "))
+		}
+		return fmt.Sprintf("The disk of volume %s (%s) has no SMART warnings anymore", a.VolumeLabel, a.Path)
+	}
+
+	percent := 0.0
+	if a.TotalSize > 0 {
+		percent = math.Round(float64(a.AvailableFreeSpace)/float64(a.TotalSize)*1000) / 10
+	}
+	if a.Firing {
+		return fmt.Sprintf("Volume %s (%s) is low on space: %d bytes (%.1f%%) free, below the threshold of %s",
+			a.VolumeLabel, a.Path, a.AvailableFreeSpace, percent, a.Threshold)
+	}
+	return fmt.Sprintf("Volume %s (%s) has enough space again: %d bytes (%.1f%%) free, threshold %s",
+		a.VolumeLabel, a.Path, a.AvailableFreeSpace, percent, a.Threshold)
+}
@@ -0,0 +1,86 @@
+package info
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// logSink writes alerts to the server log.
+type logSink struct{}
+
+func (logSink) Notify(alert Alert) error {
+	log.Print(alert.Message())
+	return nil
+}
+
+// webhookSink POSTs alerts as JSON.
+type webhookSink struct {
+	URL    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{URL: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *webhookSink) Notify(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// headerReplacer keeps volume labels from adding lines to the mail header.
+var headerReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// smtpSink emails alerts. Authentication is only used when Username is set.
+type smtpSink struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s *smtpSink) Notify(alert Alert) error {
+	if len(s.To) == 0 {
+		return fmt.Errorf("no recipients in ALERT_SMTP_TO")
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + s.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(s.To, ", ") + "\r\n")
+	msg.WriteString("Subject: " + headerReplacer.Replace(alert.Subject()) + "\r\n")
+	msg.WriteString("Date: " + alert.Time.Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(alert.Message() + "\r\n")
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(msg.String()))
+}
@@ -0,0 +1,318 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// capacitySampleInterval is how often the free space of every drive is recorded.
+const capacitySampleInterval = 5 * time.Minute
+
+// Samples are kept at full resolution for two days, as hourly averages for two months
+// and as daily averages for five years.
+const (
+	rawRetention    = 48 * time.Hour
+	hourlyRetention = 60 * 24 * time.Hour
+	dailyRetention  = 5 * 365 * 24 * time.Hour
+)
+
+// defaultForecastWindow is how far back the trend is fitted when the request doesn't say.
+const defaultForecastWindow = 30
+
+type CapacitySample struct {
+	Time               time.Time `json:"time"`
+	AvailableFreeSpace uint64    `json:"available_free_space"`
+	TotalSize          uint64    `json:"total_size"`
+}
+
+// capacitySeries is the history of one drive, in tiers of decreasing resolution. Each tier is sorted by time.
+type capacitySeries struct {
+	Raw    []CapacitySample `json:"raw"`
+	Hourly []CapacitySample `json:"hourly"`
+	Daily  []CapacitySample `json:"daily"`
+}
+
+type CapacityForecast struct {
+	// BytesPerDay is how fast the drive fills up, negative while it is emptying
+	BytesPerDay float64 `json:"bytes_per_day"`
+	// FullBy is when the drive runs out of space at that rate, unset if it isn't filling up
+	FullBy *time.Time `json:"full_by,omitempty"`
+	// WindowDays is how many days of history the trend was fitted to
+	WindowDays int `json:"window_days"`
+}
+
+var capacityHistory = map[string]*capacitySeries{}
+var capacityLock = sync.RWMutex{}
+
+// capacityHistoryFile is where the history is persisted between restarts. Empty keeps it in memory only.
+var capacityHistoryFile string
+
+// SetCapacityHistoryFile sets the file the capacity history is loaded from and saved to.
+func SetCapacityHistoryFile(path string) {
+	capacityLock.Lock()
+	capacityHistoryFile = path
+	capacityLock.Unlock()
+}
+
+// CapacityHistoryFileFromEnv reads CAPACITY_HISTORY_FILE, defaulting to capacity_history.json in the working directory.
+func CapacityHistoryFileFromEnv() string {
+	if value, ok := os.LookupEnv("CAPACITY_HISTORY_FILE"); ok {
+		return value
+	}
+	return "capacity_history.json"
+}
+
+func loadCapacityHistory() {
+	capacityLock.Lock()
+	defer capacityLock.Unlock()
+
+	if capacityHistoryFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(capacityHistoryFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Error reading capacity history: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, &capacityHistory); err != nil {
+		log.Printf("Error parsing capacity history %s: %v", capacityHistoryFile, err)
+		capacityHistory = map[string]*capacitySeries{}
+	}
+}
+
+// saveCapacityHistory writes the history to a temporary file first, so a crash can't leave it truncated.
+// The caller must hold capacityLock.
+func saveCapacityHistory() {
+	if capacityHistoryFile == "" {
+		return
+	}
+	data, err := json.Marshal(capacityHistory)
+	if err != nil {
+		log.Printf("Error encoding capacity history: %v", err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(capacityHistoryFile), filepath.Base(capacityHistoryFile)+".*")
+	if err != nil {
+		log.Printf("Error saving capacity history: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), capacityHistoryFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		log.Printf("Error saving capacity history: %v", err)
+	}
+}
+
+// recordCapacity samples every drive periodically until ctx is done.
+func recordCapacity(ctx context.Context) {
+	loadCapacityHistory()
+
+	ticker := time.NewTicker(capacitySampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping capacity sampling...")
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().UTC()
+		capacityLock.Lock()
+		for _, drive := range Drives() {
+			series, ok := capacityHistory[drive.Id]
+			if !ok {
+				series = &capacitySeries{}
+				capacityHistory[drive.Id] = series
+			}
+			series.Raw = append(series.Raw, CapacitySample{
+				Time:               now,
+				AvailableFreeSpace: drive.AvailableFreeSpace,
+				TotalSize:          drive.TotalSize,
+			})
+		}
+		for id, series := range capacityHistory {
+			series.downsample(now)
+			if len(series.Raw)+len(series.Hourly)+len(series.Daily) == 0 {
+				delete(capacityHistory, id)
+			}
+		}
+		saveCapacityHistory()
+		capacityLock.Unlock()
+	}
+}
+
+// downsample moves samples that are past a tier's retention into averages in the next tier.
+// Cut-offs are aligned to the next tier's buckets, so every bucket is averaged once, when all its samples expire.
+func (s *capacitySeries) downsample(now time.Time) {
+	var expired []CapacitySample
+	s.Raw, expired = splitBefore(s.Raw, now.Add(-rawRetention).Truncate(time.Hour))
+	s.Hourly = append(s.Hourly, average(expired, time.Hour)...)
+
+	s.Hourly, expired = splitBefore(s.Hourly, now.Add(-hourlyRetention).Truncate(24*time.Hour))
+	s.Daily = append(s.Daily, average(expired, 24*time.Hour)...)
+
+	s.Daily, _ = splitBefore(s.Daily, now.Add(-dailyRetention))
+}
+
+// splitBefore returns the samples at or after t, and those before it.
+func splitBefore(samples []CapacitySample, t time.Time) ([]CapacitySample, []CapacitySample) {
+	i := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Time.Before(t)
+	})
+	return samples[i:], samples[:i]
+}
+
+// average groups samples into buckets of the given size and averages each bucket.
+func average(samples []CapacitySample, bucket time.Duration) []CapacitySample {
+	var averaged []CapacitySample
+	for start := 0; start < len(samples); {
+		bucketTime := samples[start].Time.Truncate(bucket)
+		var available, total float64
+		end := start
+		for end < len(samples) && samples[end].Time.Truncate(bucket).Equal(bucketTime) {
+			available += float64(samples[end].AvailableFreeSpace)
+			total += float64(samples[end].TotalSize)
+			end++
+		}
+		n := float64(end - start)
+		averaged = append(averaged, CapacitySample{
+			Time:               bucketTime,
+			AvailableFreeSpace: uint64(available / n),
+			TotalSize:          uint64(total / n),
+		})
+		start = end
+	}
+	return averaged
+}
+
+// samples returns the whole history, oldest first.
+func (s *capacitySeries) samples() []CapacitySample {
+	all := make([]CapacitySample, 0, len(s.Daily)+len(s.Hourly)+len(s.Raw))
+	all = append(all, s.Daily...)
+	all = append(all, s.Hourly...)
+	all = append(all, s.Raw...)
+	return all
+}
+
+// forecast fits a line to the used space since windowStart using least squares and extrapolates when it reaches
+// the size of the drive, from the newest sample. It returns nil when there are too few samples, or they span less
+// than an hour.
+func forecast(samples []CapacitySample, windowStart time.Time) *CapacityForecast {
+	samples, _ = splitBefore(samples, windowStart)
+	if len(samples) < 2 || samples[len(samples)-1].Time.Sub(samples[0].Time) < time.Hour {
+		return nil
+	}
+
+	// Times are relative to the first sample so the sums stay precise
+	origin := samples[0].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range samples {
+		x := sample.Time.Sub(origin).Hours() / 24
+		y := float64(sample.TotalSize) - float64(sample.AvailableFreeSpace)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return nil
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+
+	result := &CapacityForecast{BytesPerDay: slope}
+	if slope > 0 {
+		latest := samples[len(samples)-1]
+		// The free space is that of the newest sample, which is older than now after downtime
+		days := float64(latest.AvailableFreeSpace) / slope
+		// Far enough out that it doesn't matter, and past what time.Duration can hold
+		if days < 100*365 {
+			fullBy := latest.Time.Add(time.Duration(days * 24 * float64(time.Hour))).Truncate(time.Second)
+			result.FullBy = &fullBy
+		}
+	}
+	return result
+}
+
+// getCapacity corresponds to the GET /info/capacity/{volume} endpoint.
+// It returns the recorded capacity of the drive, optionally since a time, and a forecast of when it fills up.
+func getCapacity(w http.ResponseWriter, r *http.Request) {
+	drive := GetDrive(mux.Vars(r)["volume"])
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	var since time.Time
+	if sinceValue := r.FormValue("since"); sinceValue != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceValue)
+		if err != nil {
+			log.Printf("Since query param error, %v", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	window := defaultForecastWindow
+	if windowValue := r.FormValue("window"); windowValue != "" {
+		var err error
+		window, err = strconv.Atoi(windowValue)
+		if err != nil || window < 1 || window > math.MaxInt32/24 {
+			log.Printf("Window query param error, %q", windowValue)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	capacityLock.RLock()
+	var samples []CapacitySample
+	if series, ok := capacityHistory[drive.Id]; ok {
+		samples = series.samples()
+	}
+	capacityLock.RUnlock()
+
+	now := time.Now().UTC()
+	response := struct {
+		Volume   string            `json:"volume"`
+		Samples  []CapacitySample  `json:"samples"`
+		Forecast *CapacityForecast `json:"forecast,omitempty"`
+	}{
+		Volume: drive.Id,
+	}
+
+	if f := forecast(samples, now.Add(-time.Duration(window)*24*time.Hour)); f != nil {
+		f.WindowDays = window
+		response.Forecast = f
+	}
+
+	response.Samples, _ = splitBefore(samples, since)
+	if response.Samples == nil {
+		response.Samples = []CapacitySample{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,167 @@
+package info
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// capacityAt returns a capacity sample of a 1000 byte drive.
+func capacityAt(t time.Time, available uint64) CapacitySample {
+	return CapacitySample{Time: t, AvailableFreeSpace: available, TotalSize: 1000}
+}
+
+func TestAverage(t *testing.T) {
+	base := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		samples []CapacitySample
+		bucket  time.Duration
+		want    []CapacitySample
+	}{
+		{"empty", nil, time.Hour, nil},
+		{"one bucket", []CapacitySample{
+			capacityAt(base.Add(5*time.Minute), 100),
+			capacityAt(base.Add(35*time.Minute), 200),
+		}, time.Hour, []CapacitySample{capacityAt(base, 150)}},
+		{"bucket edges", []CapacitySample{
+			capacityAt(base.Add(59*time.Minute), 100),
+			capacityAt(base.Add(time.Hour), 300),
+			capacityAt(base.Add(2*time.Hour-time.Second), 500),
+		}, time.Hour, []CapacitySample{capacityAt(base, 100), capacityAt(base.Add(time.Hour), 400)}},
+		{"days", []CapacitySample{
+			capacityAt(base.Add(-10*time.Hour), 100),
+			capacityAt(base.Add(13*time.Hour), 300),
+			capacityAt(base.Add(14*time.Hour), 500),
+		}, 24 * time.Hour, []CapacitySample{
+			capacityAt(base.Add(-10*time.Hour), 200),
+			capacityAt(base.Add(14*time.Hour), 500),
+		}},
+	}
+	for _, test := range tests {
+		if got := average(test.samples, test.bucket); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	now := time.Date(2024, 5, 17, 12, 30, 0, 0, time.UTC)
+	// now-48h on the hour and now-60 days at midnight, the cut-offs are aligned to the next tier's buckets
+	rawCut := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	hourlyCut := time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)
+	dailyCut := now.Add(-dailyRetention)
+
+	tests := []struct {
+		name   string
+		series capacitySeries
+		want   capacitySeries
+	}{
+		{"raw past the cut-off",
+			capacitySeries{Raw: []CapacitySample{
+				capacityAt(rawCut.Add(-50*time.Minute), 100),
+				capacityAt(rawCut.Add(-10*time.Minute), 200),
+				capacityAt(rawCut, 300),
+				capacityAt(now, 400),
+			}},
+			capacitySeries{
+				Raw:    []CapacitySample{capacityAt(rawCut, 300), capacityAt(now, 400)},
+				Hourly: []CapacitySample{capacityAt(rawCut.Add(-time.Hour), 150)},
+			}},
+		{"raw hour holding now-48h",
+			capacitySeries{Raw: []CapacitySample{
+				capacityAt(rawCut.Add(10*time.Minute), 100),
+				capacityAt(rawCut.Add(40*time.Minute), 200),
+			}},
+			capacitySeries{Raw: []CapacitySample{
+				capacityAt(rawCut.Add(10*time.Minute), 100),
+				capacityAt(rawCut.Add(40*time.Minute), 200),
+			}}},
+		{"hourly past the cut-off",
+			capacitySeries{Hourly: []CapacitySample{
+				capacityAt(hourlyCut.Add(-2*time.Hour), 100),
+				capacityAt(hourlyCut.Add(-time.Hour), 200),
+				capacityAt(hourlyCut, 300),
+				capacityAt(hourlyCut.Add(13*time.Hour), 400),
+			}},
+			capacitySeries{
+				Hourly: []CapacitySample{capacityAt(hourlyCut, 300), capacityAt(hourlyCut.Add(13*time.Hour), 400)},
+				Daily:  []CapacitySample{capacityAt(hourlyCut.Add(-24*time.Hour), 150)},
+			}},
+		{"daily past the retention",
+			capacitySeries{Daily: []CapacitySample{
+				capacityAt(dailyCut.Add(-24*time.Hour), 100),
+				capacityAt(dailyCut, 200),
+			}},
+			capacitySeries{Daily: []CapacitySample{capacityAt(dailyCut, 200)}}},
+	}
+	for _, test := range tests {
+		series := test.series
+		series.downsample(now)
+		// Emptied tiers are nil or empty depending on the split, either is fine
+		for _, tier := range []*[]CapacitySample{&series.Raw, &series.Hourly, &series.Daily} {
+			if len(*tier) == 0 {
+				*tier = nil
+			}
+		}
+		if !reflect.DeepEqual(series, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, series, test.want)
+		}
+	}
+}
+
+func TestForecast(t *testing.T) {
+	// The newest sample is a month old, like history loaded after downtime
+	start := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	linear := func(days int, usedPerDay int64) []CapacitySample {
+		var samples []CapacitySample
+		for hour := 0; hour <= days*24; hour += 6 {
+			used := 200 + usedPerDay*int64(hour)/24
+			samples = append(samples, capacityAt(start.Add(time.Duration(hour)*time.Hour), uint64(1000-used)))
+		}
+		return samples
+	}
+	full := func(t time.Time) *time.Time { return &t }
+
+	tests := []struct {
+		name        string
+		samples     []CapacitySample
+		windowStart time.Time
+		bytesPerDay float64
+		fullBy      *time.Time
+		none        bool
+	}{
+		// 600 bytes used after 4 days, the other 400 take 4 more days from the newest sample
+		{"filling", linear(4, 100), start, 100, full(start.Add(8 * 24 * time.Hour)), false},
+		{"emptying", linear(4, -40), start, -40, nil, false},
+		{"flat", linear(4, 0), start, 0, nil, false},
+		{"window", append([]CapacitySample{capacityAt(start.Add(-48*time.Hour), 100)}, linear(4, 100)...),
+			start, 100, full(start.Add(8 * 24 * time.Hour)), false},
+		{"one sample", linear(0, 100), start, 0, nil, true},
+		{"under an hour", []CapacitySample{capacityAt(start, 500), capacityAt(start.Add(30*time.Minute), 400)},
+			start, 0, nil, true},
+	}
+	for _, test := range tests {
+		got := forecast(test.samples, test.windowStart)
+		if test.none {
+			if got != nil {
+				t.Errorf("%s: got %+v, want none", test.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: got no forecast", test.name)
+			continue
+		}
+		if math.Abs(got.BytesPerDay-test.bytesPerDay) > 1e-6 {
+			t.Errorf("%s: got %v bytes per day, want %v", test.name, got.BytesPerDay, test.bytesPerDay)
+		}
+		switch {
+		case test.fullBy == nil && got.FullBy != nil:
+			t.Errorf("%s: got full by %v, want never", test.name, got.FullBy)
+		case test.fullBy != nil && (got.FullBy == nil || got.FullBy.Sub(*test.fullBy).Round(time.Second) != 0):
+			t.Errorf("%s: got full by %v, want %v", test.name, got.FullBy, test.fullBy)
+		}
+	}
+}
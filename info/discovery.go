@@ -0,0 +1,145 @@
+package info
+
+import (
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DiscoveryRules decide which mounts are exposed as drives.
+// Patterns are globs in the syntax of path.Match. Empty include lists include everything.
+type DiscoveryRules struct {
+	IncludeTypes       []string
+	ExcludeTypes       []string
+	IncludeMountPoints []string
+	ExcludeMountPoints []string
+	IncludeDevices     []string
+	ExcludeDevices     []string
+	// MinSize is the smallest total size in bytes a drive must have, 0 disables the check
+	MinSize uint64
+}
+
+var rules = DefaultDiscoveryRules()
+
+// readOnlyVolumes are forced read-only, given by Id, volume label or path
+var readOnlyVolumes []string
+
+// SetDiscoveryRules replaces the rules used by future drive discovery.
+func SetDiscoveryRules(r DiscoveryRules) {
+	lock.Lock()
+	rules = r
+	lock.Unlock()
+}
+
+// DiscoveryRulesFromEnv starts from DefaultDiscoveryRules and overrides every rule that is set in the environment:
+// DRIVE_INCLUDE_TYPES, DRIVE_EXCLUDE_TYPES, DRIVE_INCLUDE_MOUNTS, DRIVE_EXCLUDE_MOUNTS,
+// DRIVE_INCLUDE_DEVICES and DRIVE_EXCLUDE_DEVICES are comma separated lists, DRIVE_MIN_SIZE is in bytes.
+func DiscoveryRulesFromEnv() DiscoveryRules {
+	r := DefaultDiscoveryRules()
+
+	for env, list := range map[string]*[]string{
+		"DRIVE_INCLUDE_TYPES":   &r.IncludeTypes,
+		"DRIVE_EXCLUDE_TYPES":   &r.ExcludeTypes,
+		"DRIVE_INCLUDE_MOUNTS":  &r.IncludeMountPoints,
+		"DRIVE_EXCLUDE_MOUNTS":  &r.ExcludeMountPoints,
+		"DRIVE_INCLUDE_DEVICES": &r.IncludeDevices,
+		"DRIVE_EXCLUDE_DEVICES": &r.ExcludeDevices,
+	} {
+		if value, ok := os.LookupEnv(env); ok {
+			*list = splitList(value)
+		}
+	}
+
+	if value := os.Getenv("DRIVE_MIN_SIZE"); value != "" {
+		if size, err := strconv.ParseUint(value, 10, 64); err != nil {
+			log.Printf("Invalid DRIVE_MIN_SIZE %q: %v", value, err)
+		} else {
+			r.MinSize = size
+		}
+	}
+
+	return r
+}
+
+// SetReadOnlyVolumes marks volumes read-only regardless of their mount flags.
+// Volumes are given by Id, volume label or path.
+func SetReadOnlyVolumes(volumes []string) {
+	lock.Lock()
+	readOnlyVolumes = volumes
+	for id, drive := range driveMap {
+		if drive.Kind != VolumeKindPool {
+			updateDrive(id, applyReadOnly)
+		}
+	}
+	// Pools get the updated copies of their members, hidden members aren't in driveMap and are copied here
+	for id, drive := range driveMap {
+		if drive.Kind == VolumeKindPool {
+			updateDrive(id, func(pool *Drive) {
+				members := make([]*Drive, len(pool.members))
+				for i, member := range pool.members {
+					if current, ok := driveMap[member.Id]; ok {
+						members[i] = current
+						continue
+					}
+					hidden := *member
+					applyReadOnly(&hidden)
+					members[i] = &hidden
+				}
+				pool.members = members
+				applyReadOnly(pool)
+				applyPoolReadOnly(pool)
+			})
+		}
+	}
+	lock.Unlock()
+}
+
+// ReadOnlyVolumesFromEnv reads the comma separated READ_ONLY_VOLUMES environment variable.
+func ReadOnlyVolumesFromEnv() []string {
+	return splitList(os.Getenv("READ_ONLY_VOLUMES"))
+}
+
+// applyReadOnly marks the drive read-only if it's configured to be. It must be called with lock held.
+func applyReadOnly(drive *Drive) {
+	for _, volume := range readOnlyVolumes {
+		if volume == drive.Id || volume == drive.VolumeLabel || volume == drive.Path {
+			drive.ReadOnly = true
+		}
+	}
+}
+
+// Match reports whether the mount passes the type, mount point and device rules.
+// The size rule can only be checked once the drive's space is known, see createDrive.
+func (r DiscoveryRules) Match(mount *MountData) bool {
+	return matchRule(r.IncludeTypes, r.ExcludeTypes, mount.FileSystemType) &&
+		matchRule(r.IncludeMountPoints, r.ExcludeMountPoints, mount.MountPoint) &&
+		matchRule(r.IncludeDevices, r.ExcludeDevices, mount.Device)
+}
+
+func matchRule(include []string, exclude []string, value string) bool {
+	if len(include) > 0 && !matchAny(include, value) {
+		return false
+	}
+	return !matchAny(exclude, value)
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,134 @@
+// +build linux
+
+package info
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// useMountTable makes discovery read the mountinfo fixture and the given rules until the test ends.
+func useMountTable(t *testing.T, fixture string, r DiscoveryRules) {
+	t.Helper()
+	savedOpen := openMountTable
+	lock.RLock()
+	savedRules := rules
+	lock.RUnlock()
+	t.Cleanup(func() {
+		openMountTable = savedOpen
+		SetDiscoveryRules(savedRules)
+	})
+
+	openMountTable = func() (io.ReadCloser, error) {
+		return os.Open(filepath.Join("testdata", "mountinfo", fixture))
+	}
+	SetDiscoveryRules(r)
+}
+
+func discoveredMountPoints() []string {
+	var points []string
+	for _, mount := range discoverDrives() {
+		points = append(points, mount.MountPoint)
+	}
+	sort.Strings(points)
+	return points
+}
+
+func TestDiscoverDrivesDefaultRules(t *testing.T) {
+	useMountTable(t, "raspberrypi.txt", DefaultDiscoveryRules())
+
+	// The root filesystem, /boot, devtmpfs, sysfs, proc and tmpfs are left out
+	want := []string{
+		"/media/pi/Back\\slash",
+		"/media/pi/My Passport",
+		"/media/pi/Photos  2019",
+		"/media/pi/Tab\tName",
+		"/mnt/nas",
+	}
+	if got := discoveredMountPoints(); !reflect.DeepEqual(got, want) {
+		t.Errorf("discovered %q, want %q", got, want)
+	}
+}
+
+func TestDiscoverDrivesCustomRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules DiscoveryRules
+		want  []string
+	}{
+		{
+			name:  "types",
+			rules: DiscoveryRules{IncludeTypes: []string{"fuseblk"}},
+			want:  []string{"/media/pi/My Passport", "/media/pi/Photos  2019"},
+		},
+		{
+			name: "mount points",
+			rules: DiscoveryRules{
+				IncludeMountPoints: []string{"/media/pi/*"},
+				ExcludeMountPoints: []string{"/media/pi/Photos*"},
+			},
+			want: []string{"/media/pi/Back\\slash", "/media/pi/My Passport", "/media/pi/Tab\tName"},
+		},
+		{
+			name: "devices",
+			rules: DiscoveryRules{
+				IncludeDevices: []string{"/dev/sd*", "//nas/*"},
+				ExcludeDevices: []string{"/dev/sdb*"},
+			},
+			want: []string{"/media/pi/Back\\slash", "/media/pi/My Passport", "/media/pi/Tab\tName", "/mnt/nas"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useMountTable(t, "raspberrypi.txt", test.rules)
+			if got := discoveredMountPoints(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("discovered %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverDrivesMissingMountTable(t *testing.T) {
+	useMountTable(t, "does-not-exist.txt", DefaultDiscoveryRules())
+	if got := discoverDrives(); len(got) != 0 {
+		t.Errorf("discovered %d mounts without a mount table", len(got))
+	}
+}
+
+func TestDiscoveryRulesFromEnv(t *testing.T) {
+	for env, value := range map[string]string{
+		"DRIVE_INCLUDE_TYPES":  "ext4, btrfs",
+		"DRIVE_EXCLUDE_MOUNTS": "",
+		"DRIVE_MIN_SIZE":       "1000000",
+	} {
+		env := env
+		saved, ok := os.LookupEnv(env)
+		os.Setenv(env, value)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(env, saved)
+			} else {
+				os.Unsetenv(env)
+			}
+		})
+	}
+
+	r := DiscoveryRulesFromEnv()
+	if !reflect.DeepEqual(r.IncludeTypes, []string{"ext4", "btrfs"}) {
+		t.Errorf("include types %q", r.IncludeTypes)
+	}
+	// Set but empty clears the default
+	if r.ExcludeMountPoints != nil {
+		t.Errorf("exclude mount points %q, want none", r.ExcludeMountPoints)
+	}
+	if !reflect.DeepEqual(r.ExcludeDevices, DefaultDiscoveryRules().ExcludeDevices) {
+		t.Errorf("unset exclude devices %q, want the defaults", r.ExcludeDevices)
+	}
+	if r.MinSize != 1000000 {
+		t.Errorf("min size %d", r.MinSize)
+	}
+}
@@ -0,0 +1,251 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"guptaspi/metrics"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diskIOSampleInterval is how often the block device counters are read to derive rates.
+const diskIOSampleInterval = 5 * time.Second
+
+// sectorSize is the unit of the sector counters in /proc/diskstats, regardless of the device's real sector size.
+const sectorSize = 512
+
+// diskCounters are the cumulative counters the kernel keeps for a block device, see the kernel's iostats documentation.
+type diskCounters struct {
+	ReadsCompleted  uint64
+	SectorsRead     uint64
+	WritesCompleted uint64
+	SectorsWritten  uint64
+	InFlight        uint64
+	// IoTicks and WeightedIoTicks are in milliseconds
+	IoTicks         uint64
+	WeightedIoTicks uint64
+}
+
+// blockDevice is the partition a drive is on and the disk it belongs to, which are the same for unpartitioned disks.
+type blockDevice struct {
+	Device string
+	Disk   string
+}
+
+type DiskIOStats struct {
+	Volume string `json:"volume"`
+	Device string `json:"device"`
+	Disk   string `json:"disk"`
+	// Totals since boot
+	ReadBytes       uint64 `json:"read_bytes"`
+	WriteBytes      uint64 `json:"write_bytes"`
+	ReadsCompleted  uint64 `json:"reads_completed"`
+	WritesCompleted uint64 `json:"writes_completed"`
+	// Rates per second over the last sample interval
+	ReadRate  float64 `json:"read_rate"`
+	WriteRate float64 `json:"write_rate"`
+	ReadIops  float64 `json:"read_iops"`
+	WriteIops float64 `json:"write_iops"`
+	// InFlight is the number of requests currently queued on the disk
+	InFlight uint64 `json:"in_flight"`
+	// QueueDepth is the average number of queued requests over the interval
+	QueueDepth float64 `json:"queue_depth"`
+	// Utilization is the percentage of the interval the disk was busy
+	Utilization float64 `json:"utilization"`
+}
+
+type diskIOSample struct {
+	time       time.Time
+	partitions map[string]*diskCounters
+	disks      map[string]*diskCounters
+}
+
+var diskIOStats = map[string]*DiskIOStats{}
+var lastDiskIOSample *diskIOSample
+var diskIOLock = sync.RWMutex{}
+
+var (
+	volumeReadBytes = metrics.NewCounterFunc(
+		"guptaspi_volume_read_bytes_total", "Bytes read from the volume's block device.", volumeLabelNames,
+		diskIOSamples(func(s *DiskIOStats) float64 { return float64(s.ReadBytes) }),
+	)
+	volumeWriteBytes = metrics.NewCounterFunc(
+		"guptaspi_volume_written_bytes_total", "Bytes written to the volume's block device.", volumeLabelNames,
+		diskIOSamples(func(s *DiskIOStats) float64 { return float64(s.WriteBytes) }),
+	)
+	volumeReads = metrics.NewCounterFunc(
+		"guptaspi_volume_reads_completed_total", "Reads completed by the volume's block device.", volumeLabelNames,
+		diskIOSamples(func(s *DiskIOStats) float64 { return float64(s.ReadsCompleted) }),
+	)
+	volumeWrites = metrics.NewCounterFunc(
+		"guptaspi_volume_writes_completed_total", "Writes completed by the volume's block device.", volumeLabelNames,
+		diskIOSamples(func(s *DiskIOStats) float64 { return float64(s.WritesCompleted) }),
+	)
+	volumeInFlight = metrics.NewGaugeFunc(
+		"guptaspi_volume_io_in_flight", "Requests queued on the volume's disk.", volumeLabelNames,
+		diskIOSamples(func(s *DiskIOStats) float64 { return float64(s.InFlight) }),
+	)
+	volumeUtilization = metrics.NewGaugeFunc(
+		"guptaspi_volume_io_utilization_ratio", "Share of the last sample interval the volume's disk was busy.", volumeLabelNames,
+		diskIOSamples(func(s *DiskIOStats) float64 { return s.Utilization / 100 }),
+	)
+)
+
+func diskIOSamples(value func(s *DiskIOStats) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, drive := range Drives() {
+			diskIOLock.RLock()
+			stats, ok := diskIOStats[drive.Id]
+			diskIOLock.RUnlock()
+			if !ok {
+				continue
+			}
+			samples = append(samples, metrics.Sample{
+				LabelValues: []string{drive.Id, drive.VolumeLabel, drive.Path},
+				Value:       value(stats),
+			})
+		}
+		return samples
+	}
+}
+
+// sampleDiskIO reads the counters of every drive's block device and derives rates from the previous sample.
+// Drives that aren't backed by a block device, like network shares, are left out.
+func sampleDiskIO() {
+	devices := map[string]blockDevice{}
+	for _, drive := range Drives() {
+		if device, ok := resolveBlockDevice(systemRoot, drive.majorMinor, drive.device); ok {
+			devices[drive.Id] = device
+		}
+	}
+
+	sample := &diskIOSample{
+		time:       time.Now(),
+		partitions: readDiskStats(systemRoot),
+		disks:      map[string]*diskCounters{},
+	}
+	for _, device := range devices {
+		if _, ok := sample.disks[device.Disk]; !ok {
+			if counters, err := readBlockStat(systemRoot, device.Disk); err == nil {
+				sample.disks[device.Disk] = counters
+			}
+		}
+	}
+
+	diskIOLock.Lock()
+	defer diskIOLock.Unlock()
+
+	prev := lastDiskIOSample
+	next := make(map[string]*DiskIOStats, len(devices))
+	for id, device := range devices {
+		partition, ok := sample.partitions[device.Device]
+		if !ok {
+			continue
+		}
+		stats := &DiskIOStats{
+			Volume:          id,
+			Device:          device.Device,
+			Disk:            device.Disk,
+			ReadBytes:       partition.SectorsRead * sectorSize,
+			WriteBytes:      partition.SectorsWritten * sectorSize,
+			ReadsCompleted:  partition.ReadsCompleted,
+			WritesCompleted: partition.WritesCompleted,
+		}
+		disk := sample.disks[device.Disk]
+		if disk != nil {
+			stats.InFlight = disk.InFlight
+		}
+
+		if prev != nil {
+			elapsed := sample.time.Sub(prev.time)
+			if old, ok := prev.partitions[device.Device]; ok && elapsed > 0 {
+				seconds := elapsed.Seconds()
+				stats.ReadRate = float64(delta(partition.SectorsRead, old.SectorsRead)*sectorSize) / seconds
+				stats.WriteRate = float64(delta(partition.SectorsWritten, old.SectorsWritten)*sectorSize) / seconds
+				stats.ReadIops = float64(delta(partition.ReadsCompleted, old.ReadsCompleted)) / seconds
+				stats.WriteIops = float64(delta(partition.WritesCompleted, old.WritesCompleted)) / seconds
+			}
+			// Queueing and busy time are properties of the whole disk, not the partition
+			if old, ok := prev.disks[device.Disk]; ok && disk != nil && elapsed > 0 {
+				milliseconds := float64(elapsed / time.Millisecond)
+				stats.QueueDepth = float64(delta(disk.WeightedIoTicks, old.WeightedIoTicks)) / milliseconds
+				stats.Utilization = float64(delta(disk.IoTicks, old.IoTicks)) / milliseconds * 100
+				if stats.Utilization > 100 {
+					stats.Utilization = 100
+				}
+			}
+		}
+		next[id] = stats
+	}
+
+	diskIOStats = next
+	lastDiskIOSample = sample
+}
+
+// delta is the increase of a counter, zero if it was reset.
+func delta(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return 0
+	}
+	return current - previous
+}
+
+// recordDiskIO samples the block devices periodically until ctx is done.
+func recordDiskIO(ctx context.Context) {
+	ticker := time.NewTicker(diskIOSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		sampleDiskIO()
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping disk I/O sampling...")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getDiskIO corresponds to the GET /info/io endpoint.
+// It returns the I/O statistics of every volume on a block device, ordered by volume.
+func getDiskIO(w http.ResponseWriter, _ *http.Request) {
+	diskIOLock.RLock()
+	stats := make([]*DiskIOStats, 0, len(diskIOStats))
+	for _, s := range diskIOStats {
+		stats = append(stats, s)
+	}
+	diskIOLock.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Volume < stats[j].Volume
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// getVolumeIO corresponds to the GET /info/io/{volume} endpoint.
+func getVolumeIO(w http.ResponseWriter, r *http.Request) {
+	drive := GetDrive(mux.Vars(r)["volume"])
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	diskIOLock.RLock()
+	stats, ok := diskIOStats[drive.Id]
+	diskIOLock.RUnlock()
+	if !ok {
+		http.Error(w, "volume is not on a block device", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,99 @@
+// +build linux
+
+package info
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readDiskStats parses /proc/diskstats below root into counters by device name.
+func readDiskStats(root string) map[string]*diskCounters {
+	stats := map[string]*diskCounters{}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "proc/diskstats"))
+	if err != nil {
+		return stats
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// major minor name, then the same fields as /sys/block/<disk>/stat
+		fields := strings.Fields(line)
+		if len(fields) < 14 {
+			continue
+		}
+		if counters, err := parseDiskCounters(fields[3:]); err == nil {
+			stats[fields[2]] = counters
+		}
+	}
+
+	return stats
+}
+
+// readBlockStat reads the counters of a whole disk from /sys/block/<disk>/stat below root.
+func readBlockStat(root string, disk string) (*diskCounters, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, "sys/block", disk, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	return parseDiskCounters(strings.Fields(string(data)))
+}
+
+// parseDiskCounters parses the fields of a stat file, see Documentation/block/stat.rst in the kernel.
+func parseDiskCounters(fields []string) (*diskCounters, error) {
+	if len(fields) < 11 {
+		return nil, strconv.ErrSyntax
+	}
+
+	values := make([]uint64, 11)
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	return &diskCounters{
+		ReadsCompleted:  values[0],
+		SectorsRead:     values[2],
+		WritesCompleted: values[4],
+		SectorsWritten:  values[6],
+		InFlight:        values[8],
+		IoTicks:         values[9],
+		WeightedIoTicks: values[10],
+	}, nil
+}
+
+// resolveBlockDevice finds the block device with the given major:minor number through /sys/dev/block below root.
+// Partitions link into their disk's directory, e.g. .../block/sda/sda1. Filesystems like btrfs report an
+// anonymous 0:N number in the mount table, so the device node, e.g. /dev/sdb1, is looked up in /sys/class/block then.
+func resolveBlockDevice(root string, majorMinor string, device string) (blockDevice, bool) {
+	var links []string
+	if majorMinor != "" {
+		links = append(links, filepath.Join(root, "sys/dev/block", majorMinor))
+	}
+	if strings.HasPrefix(device, "/dev/") {
+		links = append(links, filepath.Join(root, "sys/class/block", filepath.Base(device)))
+	}
+
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(link), target)
+		}
+
+		resolved := blockDevice{Device: filepath.Base(target), Disk: filepath.Base(target)}
+		if _, err := os.Stat(filepath.Join(target, "partition")); err == nil {
+			resolved.Disk = filepath.Base(filepath.Dir(target))
+		}
+		return resolved, true
+	}
+	return blockDevice{}, false
+}
@@ -0,0 +1,257 @@
+// +build linux
+
+package info
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const fixtureDiskStats = `   1       0 ram0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0
+ 179       0 mmcblk0 41872 11834 2771418 30412 18840 20338 1213584 160736 0 93900 191148 0 0 0 0 0 0
+ 179       1 mmcblk0p1 203 564 7616 252 2 0 2 3 0 292 255 0 0 0 0 0 0
+   8       0 sda 5120 300 1048576 9000 2048 100 524288 12000 1 15000 21000 0 0 0 0 0 0
+   8       1 sda1 5000 300 1040000 8900 2048 100 524288 12000 1 14900 20900 0 0 0 0 0 0
+ bad line
+`
+
+// sysfsFixture builds the sysfs links of a USB disk sda with one partition and an SD card below a temporary
+// directory, along with /proc/diskstats, and points systemRoot at it until the test ends.
+func sysfsFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+
+	usb := "sys/devices/platform/scb/usb1/1-1"
+	sda := usb + "/host0/target0:0:0/0:0:0:0/block/sda"
+	mmcblk0 := "sys/devices/platform/emmc2bus/mmc0/mmc0:aaaa/block/mmcblk0"
+	files := map[string]string{
+		"proc/diskstats":                                      fixtureDiskStats,
+		sda + "/stat":                                         "5120 300 1048576 9000 2048 100 524288 12000 1 15000 21000 0 0 0 0 0 0\n",
+		sda + "/sda1/partition":                               "1\n",
+		usb + "/serial":                                       "575834314131383430303936\n",
+		usb + "/host0/target0:0:0/0:0:0:0/model":              "Elements 25A2   \n",
+		usb + "/host0/target0:0:0/0:0:0:0/vendor":             "WD      \n",
+		mmcblk0 + "/stat":                                     "41872 11834 2771418 30412 18840 20338 1213584 160736 0 93900 191148\n",
+		mmcblk0 + "/mmcblk0p1/partition":                      "1\n",
+		"sys/devices/platform/emmc2bus/mmc0/mmc0:aaaa/name":   "SC64G\n",
+		"sys/devices/platform/emmc2bus/mmc0/mmc0:aaaa/serial": "0x1f2e3d4c\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The kernel's links are relative, like ../../devices/...
+	links := map[string]string{
+		"sys/dev/block/8:0":    "../../../" + sda,
+		"sys/dev/block/8:1":    "../../../" + sda + "/sda1",
+		"sys/dev/block/179:0":  "../../../" + mmcblk0,
+		"sys/dev/block/179:1":  "../../../" + mmcblk0 + "/mmcblk0p1",
+		"sys/class/block/sda1": "../../../" + sda + "/sda1",
+		"sys/block/sda":        "../../" + sda,
+		"sys/block/mmcblk0":    "../../" + mmcblk0,
+		sda + "/device":        "../../../0:0:0:0",
+		mmcblk0 + "/device":    "../../../mmc0:aaaa",
+	}
+	for name, target := range links {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := systemRoot
+	systemRoot = root
+	t.Cleanup(func() {
+		systemRoot = saved
+	})
+	return root
+}
+
+func TestReadDiskStats(t *testing.T) {
+	root := sysfsFixture(t)
+
+	stats := readDiskStats(root)
+	if len(stats) != 5 {
+		t.Errorf("got %d devices, want 5", len(stats))
+	}
+	want := diskCounters{
+		ReadsCompleted:  5000,
+		SectorsRead:     1040000,
+		WritesCompleted: 2048,
+		SectorsWritten:  524288,
+		InFlight:        1,
+		IoTicks:         14900,
+		WeightedIoTicks: 20900,
+	}
+	if sda1 := stats["sda1"]; sda1 == nil || *sda1 != want {
+		t.Errorf("sda1 %+v, want %+v", sda1, want)
+	}
+
+	disk, err := readBlockStat(root, "sda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.IoTicks != 15000 || disk.WeightedIoTicks != 21000 || disk.InFlight != 1 {
+		t.Errorf("sda %+v", disk)
+	}
+	if _, err := readBlockStat(root, "sdz"); err == nil {
+		t.Error("read the stat of a missing disk")
+	}
+
+	if stats := readDiskStats(t.TempDir()); len(stats) != 0 {
+		t.Errorf("got %d devices without /proc/diskstats", len(stats))
+	}
+}
+
+func TestParseDiskCounters(t *testing.T) {
+	// Kernels before 4.18 only have the first 11 fields
+	if _, err := parseDiskCounters([]string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseDiskCounters([]string{"1", "2", "3"}); err == nil {
+		t.Error("parsed a short line")
+	}
+	if _, err := parseDiskCounters([]string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "x"}); err == nil {
+		t.Error("parsed a counter that isn't a number")
+	}
+}
+
+func TestResolveBlockDevice(t *testing.T) {
+	root := sysfsFixture(t)
+
+	tests := []struct {
+		majorMinor string
+		node       string
+		ok         bool
+		device     blockDevice
+	}{
+		{"8:1", "/dev/sda1", true, blockDevice{Device: "sda1", Disk: "sda"}},
+		// Unpartitioned disks are their own disk
+		{"8:0", "/dev/sda", true, blockDevice{Device: "sda", Disk: "sda"}},
+		{"179:1", "/dev/mmcblk0p1", true, blockDevice{Device: "mmcblk0p1", Disk: "mmcblk0"}},
+		// btrfs reports an anonymous device number, the device node is looked up instead
+		{"0:26", "/dev/sda1", true, blockDevice{Device: "sda1", Disk: "sda"}},
+		{"0:52", "//nas/share", false, blockDevice{}},
+		{"0:27", "/dev/sdz1", false, blockDevice{}},
+	}
+	for _, test := range tests {
+		device, ok := resolveBlockDevice(root, test.majorMinor, test.node)
+		if ok != test.ok || device != test.device {
+			t.Errorf("resolveBlockDevice(%s, %s) = %+v %v, want %+v %v",
+				test.majorMinor, test.node, device, ok, test.device, test.ok)
+		}
+	}
+}
+
+func TestReadDiskIdentity(t *testing.T) {
+	root := sysfsFixture(t)
+
+	tests := []struct {
+		majorMinor string
+		node       string
+		model      string
+		serial     string
+	}{
+		// The serial is on the USB device, three levels above the disk
+		{"8:1", "/dev/sda1", "WD Elements 25A2", "575834314131383430303936"},
+		{"0:26", "/dev/sda1", "WD Elements 25A2", "575834314131383430303936"},
+		// SD cards report their name
+		{"179:1", "/dev/mmcblk0p1", "SC64G", "0x1f2e3d4c"},
+		{"0:52", "//nas/share", "", ""},
+		{"", "", "", ""},
+	}
+	for _, test := range tests {
+		model, serial := readDiskIdentity(root, test.majorMinor, test.node)
+		if model != test.model || serial != test.serial {
+			t.Errorf("readDiskIdentity(%q, %q) = %q %q, want %q %q",
+				test.majorMinor, test.node, model, serial, test.model, test.serial)
+		}
+	}
+}
+
+func TestSmartDevice(t *testing.T) {
+	sysfsFixture(t)
+
+	tests := []struct {
+		drive *Drive
+		want  string
+	}{
+		{&Drive{majorMinor: "8:1", device: "/dev/sda1"}, "/dev/sda"},
+		{&Drive{majorMinor: "179:1", device: "/dev/mmcblk0p1"}, "/dev/mmcblk0"},
+		{&Drive{majorMinor: "0:26", device: "/dev/sda1"}, "/dev/sda"},
+		// Network shares have no disk
+		{&Drive{majorMinor: "0:52", device: "//nas/share"}, ""},
+	}
+	for _, test := range tests {
+		if got := smartDevice(test.drive); got != test.want {
+			t.Errorf("smartDevice(%s) = %q, want %q", test.drive.device, got, test.want)
+		}
+	}
+}
+
+func TestSampleDiskIO(t *testing.T) {
+	sysfsFixture(t)
+
+	lock.Lock()
+	savedDrives := driveMap
+	driveMap = map[string]*Drive{
+		"usb":   {Id: "usb", majorMinor: "8:1", device: "/dev/sda1"},
+		"btrfs": {Id: "btrfs", majorMinor: "0:26", device: "/dev/sda1"},
+		"share": {Id: "share", majorMinor: "0:52", device: "//nas/share"},
+	}
+	lock.Unlock()
+	diskIOLock.Lock()
+	savedStats, savedSample := diskIOStats, lastDiskIOSample
+	// One second ago sda1 had read 1000 sectors and the disk had been busy for 500ms less
+	lastDiskIOSample = &diskIOSample{
+		time:       time.Now().Add(-time.Second),
+		partitions: map[string]*diskCounters{"sda1": {SectorsRead: 1040000 - 1000, ReadsCompleted: 4990}},
+		disks:      map[string]*diskCounters{"sda": {IoTicks: 15000 - 500, WeightedIoTicks: 21000 - 1000}},
+	}
+	diskIOLock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		driveMap = savedDrives
+		lock.Unlock()
+		diskIOLock.Lock()
+		diskIOStats, lastDiskIOSample = savedStats, savedSample
+		diskIOLock.Unlock()
+	})
+
+	sampleDiskIO()
+
+	diskIOLock.RLock()
+	defer diskIOLock.RUnlock()
+	if _, ok := diskIOStats["share"]; ok {
+		t.Error("network share has I/O statistics")
+	}
+	if btrfs := diskIOStats["btrfs"]; btrfs == nil || btrfs.Device != "sda1" {
+		t.Errorf("btrfs subvolume has I/O statistics %+v, want those of sda1", btrfs)
+	}
+	stats := diskIOStats["usb"]
+	if stats == nil {
+		t.Fatal("no I/O statistics for the USB disk")
+	}
+	if stats.Device != "sda1" || stats.Disk != "sda" || stats.ReadBytes != 1040000*sectorSize || stats.InFlight != 1 {
+		t.Errorf("got %+v", stats)
+	}
+	// The sample takes a moment, so the rates are a little lower than per exactly one second
+	if stats.ReadRate < 400000 || stats.ReadRate > 1000*sectorSize || stats.ReadIops < 9 || stats.ReadIops > 10 {
+		t.Errorf("read rate %v, iops %v", stats.ReadRate, stats.ReadIops)
+	}
+	if stats.Utilization < 45 || stats.Utilization > 50 || stats.QueueDepth < 0.9 || stats.QueueDepth > 1 {
+		t.Errorf("utilization %v, queue depth %v", stats.Utilization, stats.QueueDepth)
+	}
+}
@@ -0,0 +1,18 @@
+// +build windows
+
+package info
+
+import "os"
+
+// readDiskStats has no /proc/diskstats to read on Windows, so no volume reports I/O statistics.
+func readDiskStats(_ string) map[string]*diskCounters {
+	return map[string]*diskCounters{}
+}
+
+func readBlockStat(_ string, _ string) (*diskCounters, error) {
+	return nil, os.ErrNotExist
+}
+
+func resolveBlockDevice(_ string, _ string, _ string) (blockDevice, bool) {
+	return blockDevice{}, false
+}
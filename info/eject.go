@@ -0,0 +1,338 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EjectWaiting    = "waiting"
+	EjectSyncing    = "syncing"
+	EjectUnmounting = "unmounting"
+	EjectSafe       = "safe"
+	EjectFailed     = "failed"
+	EjectAborted    = "aborted"
+)
+
+// defaultEjectTimeout is how long an eject waits for in-flight work on the volume when the request doesn't say.
+const defaultEjectTimeout = 10 * time.Minute
+
+// ErrEjecting is returned for operations on a volume that is being ejected.
+var ErrEjecting = errors.New("volume is being ejected")
+
+var errNotEjectable = errors.New("only drives can be ejected")
+var errAlreadyEjecting = errors.New("volume is already being ejected")
+
+// EjectHandler is called during an eject, once new operations on the volume are refused.
+// It returns when nothing on the volume is in use anymore, or with ctx's error if it's done first.
+// With cancel set, in-flight work is aborted instead of waited for.
+type EjectHandler func(ctx context.Context, volume string, cancel bool) error
+
+// EjectStatus reports the progress of an eject. Once State is safe the drive can be unplugged.
+type EjectStatus struct {
+	Volume      string     `json:"volume"`
+	VolumeLabel string     `json:"volume_label"`
+	Path        string     `json:"path"`
+	State       string     `json:"state"`
+	Cancel      bool       `json:"cancel"`
+	Error       string     `json:"error,omitempty"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+
+	abort context.CancelFunc
+}
+
+// active reports whether the eject still holds off operations on the volume.
+func (s *EjectStatus) active() bool {
+	return s.State == EjectWaiting || s.State == EjectSyncing || s.State == EjectUnmounting
+}
+
+// ejects holds the latest eject of each drive by Id. It is guarded by lock, like driveMap.
+var ejects = map[string]*EjectStatus{}
+
+var ejectHandlers []EjectHandler
+var ejectHandlersLock = sync.Mutex{}
+
+// ejectCommand unmounts a volume. {path}, {device}, {id} and {label} in its arguments are replaced by the drive's.
+var ejectCommand = defaultEjectCommand
+
+// AddEjectHandler registers h to be called whenever a volume is ejected.
+func AddEjectHandler(h EjectHandler) {
+	ejectHandlersLock.Lock()
+	ejectHandlers = append(ejectHandlers, h)
+	ejectHandlersLock.Unlock()
+}
+
+// SetEjectCommand sets the command that unmounts volumes. An empty command only flushes them.
+func SetEjectCommand(command []string) {
+	lock.Lock()
+	ejectCommand = command
+	lock.Unlock()
+}
+
+// EjectCommandFromEnv reads EJECT_COMMAND, split on spaces, defaulting to the platform's unmount command.
+func EjectCommandFromEnv() []string {
+	if value, ok := os.LookupEnv("EJECT_COMMAND"); ok {
+		return strings.Fields(value)
+	}
+	return defaultEjectCommand
+}
+
+// applyEjecting marks the drive while it's being ejected. It must be called with lock held.
+func applyEjecting(drive *Drive) {
+	status, ok := ejects[drive.Id]
+	drive.Ejecting = ok && status.active()
+}
+
+// CheckAvailable returns ErrEjecting if the drive is being ejected and ErrUnresponsive while it is degraded.
+// Every operation on files should call it first.
+func (d *Drive) CheckAvailable() error {
+	lock.RLock()
+	defer lock.RUnlock()
+	if status, ok := ejects[d.Id]; ok && status.active() {
+		return ErrEjecting
+	}
+	if _, all := d.degraded(); all {
+		return ErrUnresponsive
+	}
+	return nil
+}
+
+// ErrorStatus maps the errors of CheckWritable, CheckAvailable and PlaceFile to HTTP status codes.
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, ErrEjecting):
+		return http.StatusConflict
+	case errors.Is(err, ErrNoSpace):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrUnresponsive):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// setEjectState updates an eject's state. It must be called without lock held.
+func setEjectState(status *EjectStatus, state string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	status.State = state
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if !status.active() {
+		now := time.Now().UTC()
+		status.Finished = &now
+	}
+	updateDrive(status.Volume, applyEjecting)
+}
+
+// eject drains the volume, flushes it and runs the eject command.
+func eject(ctx context.Context, drive *Drive, status *EjectStatus, timeout time.Duration) {
+	ejectHandlersLock.Lock()
+	handlers := append([]EjectHandler{}, ejectHandlers...)
+	ejectHandlersLock.Unlock()
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for _, h := range handlers {
+		if err := h(waitCtx, drive.Id, status.Cancel); err != nil {
+			state := EjectFailed
+			if errors.Is(err, context.Canceled) {
+				state = EjectAborted
+			}
+			setEjectState(status, state, fmt.Errorf("waiting for in-flight operations: %w", err))
+			return
+		}
+	}
+
+	setEjectState(status, EjectSyncing, nil)
+	if err := Guard(drive.Path, func() error { return syncVolume(drive.Path) }); err != nil {
+		setEjectState(status, EjectFailed, fmt.Errorf("flushing volume: %w", err))
+		return
+	}
+
+	lock.RLock()
+	command := ejectCommand
+	lock.RUnlock()
+	if len(command) == 0 {
+		setEjectState(status, EjectSafe, nil)
+		return
+	}
+
+	setEjectState(status, EjectUnmounting, nil)
+	replacer := strings.NewReplacer("{path}", drive.Path, "{device}", drive.device, "{id}", drive.Id, "{label}", drive.VolumeLabel)
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = replacer.Replace(arg)
+	}
+	cmdCtx, cmdCancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cmdCancel()
+	if output, err := exec.CommandContext(cmdCtx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		setEjectState(status, EjectFailed, fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(string(output))))
+		return
+	}
+
+	// The watcher would notice too, this removes the drive right away
+	refreshDrives()
+	lock.RLock()
+	current, stillMounted := driveMap[drive.Id]
+	lock.RUnlock()
+	if stillMounted && current.Path == drive.Path {
+		setEjectState(status, EjectFailed, errors.New("volume is still mounted after the eject command"))
+		return
+	}
+
+	log.Printf("Volume %s at %s is safe to remove", drive.VolumeLabel, drive.Path)
+	setEjectState(status, EjectSafe, nil)
+}
+
+// startEject corresponds to the POST /info/eject/{volume} endpoint.
+// New uploads and file operations on the volume are refused from now on. With cancel=true in-flight uploads are
+// aborted, otherwise they are waited for, for up to timeout seconds.
+func startEject(w http.ResponseWriter, r *http.Request) {
+	drive := GetDrive(mux.Vars(r)["volume"])
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	var cancelUploads bool
+	if cancelValue := r.FormValue("cancel"); cancelValue != "" {
+		var err error
+		cancelUploads, err = strconv.ParseBool(cancelValue)
+		if err != nil {
+			log.Printf("Cancel query param error, %v", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	timeout := defaultEjectTimeout
+	if timeoutValue := r.FormValue("timeout"); timeoutValue != "" {
+		seconds, err := strconv.Atoi(timeoutValue)
+		if err != nil || seconds < 0 {
+			log.Printf("Timeout query param error, %q", timeoutValue)
+			w.WriteHeader(400)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	response, err := Eject(drive, cancelUploads, timeout)
+	if err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// Eject starts ejecting a drive in the background and returns its initial status, see startEject.
+// It fails if the volume isn't a drive or is already being ejected.
+func Eject(drive *Drive, cancel bool, timeout time.Duration) (EjectStatus, error) {
+	if drive.Kind != VolumeKindDrive {
+		return EjectStatus{}, errNotEjectable
+	}
+
+	ctx, abort := context.WithCancel(context.Background())
+	status := &EjectStatus{
+		Volume:      drive.Id,
+		VolumeLabel: drive.VolumeLabel,
+		Path:        drive.Path,
+		State:       EjectWaiting,
+		Cancel:      cancel,
+		Started:     time.Now().UTC(),
+		abort:       abort,
+	}
+
+	lock.Lock()
+	if existing, ok := ejects[drive.Id]; ok && existing.active() {
+		lock.Unlock()
+		abort()
+		return EjectStatus{}, errAlreadyEjecting
+	}
+	ejects[drive.Id] = status
+	updateDrive(drive.Id, applyEjecting)
+	response := *status
+	lock.Unlock()
+
+	go func() {
+		defer abort()
+		eject(ctx, drive, status, timeout)
+	}()
+
+	return response, nil
+}
+
+// getEject corresponds to the GET /info/eject/{volume} endpoint.
+// Volumes that were ejected aren't mounted anymore, so they are found by Id or label among the ejects too.
+func getEject(w http.ResponseWriter, r *http.Request) {
+	volume := mux.Vars(r)["volume"]
+
+	lock.RLock()
+	status, ok := ejects[volume]
+	if !ok {
+		for _, s := range ejects {
+			if s.VolumeLabel == volume {
+				status, ok = s, true
+			}
+		}
+	}
+	var response EjectStatus
+	if ok {
+		response = *status
+	}
+	lock.RUnlock()
+
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// abortEject corresponds to the DELETE /info/eject/{volume} endpoint.
+// Only ejects that are still waiting for in-flight operations can be aborted, the volume is usable again afterwards.
+func abortEject(w http.ResponseWriter, r *http.Request) {
+	drive := GetDrive(mux.Vars(r)["volume"])
+	if drive == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	lock.RLock()
+	status, ok := ejects[drive.Id]
+	waiting := ok && status.State == EjectWaiting
+	lock.RUnlock()
+
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	if !waiting {
+		http.Error(w, "eject can only be aborted while waiting", 409)
+		return
+	}
+
+	status.abort()
+	w.WriteHeader(204)
+}
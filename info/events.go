@@ -0,0 +1,185 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventDriveAdded   = "drive-added"
+	EventDriveRemoved = "drive-removed"
+)
+
+// DriveEvent is published whenever a drive appears or disappears.
+type DriveEvent struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Drive *Drive    `json:"drive"`
+}
+
+var subscribers = map[chan DriveEvent]struct{}{}
+var subscribersLock = sync.Mutex{}
+
+// Subscribe returns a channel receiving every future drive event. It must be released with Unsubscribe.
+func Subscribe() chan DriveEvent {
+	c := make(chan DriveEvent, 16)
+	subscribersLock.Lock()
+	subscribers[c] = struct{}{}
+	subscribersLock.Unlock()
+	return c
+}
+
+func Unsubscribe(c chan DriveEvent) {
+	subscribersLock.Lock()
+	delete(subscribers, c)
+	subscribersLock.Unlock()
+}
+
+// publish sends the event to every subscriber. Slow subscribers miss events instead of blocking the watcher.
+func publish(event DriveEvent) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	for c := range subscribers {
+		select {
+		case c <- event:
+		default:
+		}
+	}
+}
+
+// mountTimes holds when each mount was first seen, by drive Id and path. It is guarded by lock.
+// Mounts found by the first discovery predate the server and have a zero time.
+var mountTimes map[string]time.Time
+
+// applyMountTimes sets the mount time of the drives and forgets mounts that are gone.
+// It must be called with lock held.
+func applyMountTimes(drives []*Drive, now time.Time) {
+	first := mountTimes == nil
+	next := make(map[string]time.Time, len(drives))
+	for _, drive := range drives {
+		if drive.Kind != VolumeKindDrive {
+			continue
+		}
+		key := drive.Id + "\x00" + drive.Path
+		mounted, ok := mountTimes[key]
+		if !ok && !first {
+			mounted = now
+		}
+		next[key] = mounted
+		if !mounted.IsZero() {
+			drive.MountTime = &mounted
+		}
+	}
+	mountTimes = next
+}
+
+// refreshDrives rediscovers the drives, swaps them into driveMap and publishes what changed.
+func refreshDrives() {
+	var drives []*Drive
+	for _, mount := range discoverDrives() {
+		if drive, err := createDrive(mount); err == nil {
+			drives = append(drives, drive)
+		}
+	}
+	lock.RLock()
+	entries := registry
+	lock.RUnlock()
+	drives = applyRegistry(drives, entries)
+	disambiguate(drives)
+
+	next := make(map[string]*Drive, len(drives))
+	for _, drive := range drives {
+		next[drive.Id] = drive
+	}
+
+	now := time.Now().UTC()
+	lock.Lock()
+	applyMountTimes(drives, now)
+	for _, drive := range drives {
+		for _, member := range drive.members {
+			applyReadOnly(member)
+		}
+		applyReadOnly(drive)
+		applyPoolReadOnly(drive)
+		applyAlert(drive)
+		applyHealth(drive)
+		applyDegraded(drive, driveMap[drive.Id])
+		applyEjecting(drive)
+	}
+	prev := driveMap
+	driveMap = next
+	lock.Unlock()
+
+	for id, drive := range next {
+		if old, ok := prev[id]; !ok || old.Path != drive.Path {
+			publish(DriveEvent{Type: EventDriveAdded, Time: now, Drive: drive})
+		}
+	}
+	for id, drive := range prev {
+		if cur, ok := next[id]; !ok || cur.Path != drive.Path {
+			publish(DriveEvent{Type: EventDriveRemoved, Time: now, Drive: drive})
+		}
+	}
+}
+
+// watchDrives keeps driveMap in sync with the mount table until ctx is done.
+func watchDrives(ctx context.Context) {
+	log.Printf("Watching mount table for drive changes...")
+	changes := make(chan struct{}, 1)
+	go watchMounts(ctx, changes)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping drive watcher...")
+			return
+		case <-changes:
+			refreshDrives()
+		}
+	}
+}
+
+// getEvents corresponds to the GET /info/events endpoint.
+// It streams drive events as Server-Sent Events until the client disconnects.
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+
+	c := Subscribe()
+	defer Unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	// Comments keep proxies from closing idle streams
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, _ = fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-c:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error encoding drive event: %v", err)
+				continue
+			}
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
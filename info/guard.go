@@ -0,0 +1,257 @@
+package info
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrUnresponsive is returned for calls to a volume that timed out, and right away while the volume is degraded.
+var ErrUnresponsive = errors.New("volume is not responding")
+
+// GuardConfig configures the deadlines of filesystem calls and when volumes are considered degraded.
+type GuardConfig struct {
+	// Timeout is the deadline of every guarded filesystem call
+	Timeout time.Duration
+	// Threshold is how many timeouts in a row degrade a volume
+	Threshold int
+	// ProbeInterval is how often degraded volumes are checked for recovery
+	ProbeInterval time.Duration
+}
+
+var guardConfig = GuardConfig{Timeout: 10 * time.Second, Threshold: 3, ProbeInterval: 15 * time.Second}
+
+// breaker tracks the calls to one volume root. A tripped breaker fails calls until a probe gets through.
+type breaker struct {
+	timeouts int
+	tripped  bool
+	// stuck counts the calls that timed out and haven't returned yet, probes wait for them
+	stuck int
+}
+
+// breakers holds the breaker of every root that had a call, by path. It is guarded by breakersLock.
+var breakers = map[string]*breaker{}
+var breakersLock = sync.Mutex{}
+
+// SetGuardConfig replaces the deadlines and thresholds.
+func SetGuardConfig(config GuardConfig) {
+	breakersLock.Lock()
+	guardConfig = config
+	breakersLock.Unlock()
+}
+
+// GuardConfigFromEnv reads VOLUME_TIMEOUT and VOLUME_PROBE_INTERVAL, durations,
+// and VOLUME_TIMEOUT_THRESHOLD, the number of timeouts in a row that degrade a volume.
+func GuardConfigFromEnv() GuardConfig {
+	config := guardConfig
+	for env, d := range map[string]*time.Duration{
+		"VOLUME_TIMEOUT":        &config.Timeout,
+		"VOLUME_PROBE_INTERVAL": &config.ProbeInterval,
+	} {
+		if value := os.Getenv(env); value != "" {
+			if parsed, err := time.ParseDuration(value); err != nil || parsed <= 0 {
+				log.Printf("Invalid %s %q, using %s", env, value, *d)
+			} else {
+				*d = parsed
+			}
+		}
+	}
+	if value := os.Getenv("VOLUME_TIMEOUT_THRESHOLD"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			log.Printf("Invalid VOLUME_TIMEOUT_THRESHOLD %q, using %d", value, config.Threshold)
+		} else {
+			config.Threshold = n
+		}
+	}
+	return config
+}
+
+// Guard runs fn, which accesses the filesystem below root, with the volume deadline. Once fn took too long
+// Guard returns ErrUnresponsive and leaves fn running in the background, it can't be interrupted.
+// While the volume is degraded fn isn't run at all.
+func Guard(root string, fn func() error) error {
+	breakersLock.Lock()
+	b, ok := breakers[root]
+	if !ok {
+		b = &breaker{}
+		breakers[root] = b
+	}
+	if b.tripped {
+		breakersLock.Unlock()
+		return ErrUnresponsive
+	}
+	timeout := guardConfig.Timeout
+	breakersLock.Unlock()
+
+	if err, ok := callWithin(b, fn, timeout); ok {
+		breakersLock.Lock()
+		b.timeouts = 0
+		breakersLock.Unlock()
+		return err
+	}
+
+	breakersLock.Lock()
+	b.timeouts++
+	trip := !b.tripped && b.timeouts >= guardConfig.Threshold
+	if trip {
+		b.tripped = true
+	}
+	breakersLock.Unlock()
+
+	if trip {
+		log.Printf("Volume at %s stopped responding, failing calls to it until it recovers", root)
+		go probe(root, b)
+	}
+	return ErrUnresponsive
+}
+
+// GuardReader returns a reader whose reads from r, a file below root, each run with the volume deadline like Guard.
+// A file on a volume that stops responding fails with ErrUnresponsive instead of blocking the reader for good.
+func GuardReader(root string, r io.Reader) io.Reader {
+	return guardedReader{root: root, r: r}
+}
+
+type guardedReader struct {
+	root string
+	r    io.Reader
+}
+
+func (g guardedReader) Read(p []byte) (int, error) {
+	var n int
+	err := Guard(g.root, func() (err error) {
+		n, err = g.r.Read(p)
+		return err
+	})
+	if err == ErrUnresponsive {
+		// The read may still be running, n is not ours to look at
+		return 0, err
+	}
+	return n, err
+}
+
+// ContextReader returns a reader that stops reading from r once ctx is done, like when the client of a download
+// disconnected or an import was cancelled.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// callWithin runs fn and waits up to timeout for it. The second return value is false if fn didn't return in time.
+func callWithin(b *breaker, fn func() error, timeout time.Duration) (error, bool) {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err, true
+	case <-timer.C:
+	}
+
+	breakersLock.Lock()
+	b.stuck++
+	breakersLock.Unlock()
+	go func() {
+		<-done
+		breakersLock.Lock()
+		b.stuck--
+		breakersLock.Unlock()
+	}()
+	return nil, false
+}
+
+// probe checks a degraded volume until a call to it succeeds. No probe is sent while earlier calls are still
+// stuck, so a dead mount doesn't collect a blocked goroutine per interval.
+func probe(root string, b *breaker) {
+	for {
+		breakersLock.Lock()
+		interval := guardConfig.ProbeInterval
+		timeout := guardConfig.Timeout
+		breakersLock.Unlock()
+		time.Sleep(interval)
+
+		breakersLock.Lock()
+		stuck := b.stuck
+		breakersLock.Unlock()
+		if stuck > 0 {
+			continue
+		}
+
+		err, ok := callWithin(b, func() error {
+			_, err := os.Stat(root)
+			return err
+		}, timeout)
+		if !ok {
+			continue
+		}
+		if err != nil && os.IsNotExist(err) {
+			// The volume was unmounted, there is nothing left to recover
+			breakersLock.Lock()
+			delete(breakers, root)
+			breakersLock.Unlock()
+			return
+		}
+		if err == nil {
+			breakersLock.Lock()
+			b.tripped = false
+			b.timeouts = 0
+			breakersLock.Unlock()
+			log.Printf("Volume at %s is responding again", root)
+			return
+		}
+	}
+}
+
+// degraded reports whether calls to root currently fail fast.
+func degraded(root string) bool {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	b, ok := breakers[root]
+	return ok && b.tripped
+}
+
+// degraded reports whether the drive doesn't respond. Pools are degraded once any member is, but stay
+// available until all of them are.
+func (d *Drive) degraded() (some bool, all bool) {
+	roots := d.Roots()
+	count := 0
+	for _, root := range roots {
+		if degraded(root) {
+			count++
+		}
+	}
+	return count > 0, count == len(roots)
+}
+
+// applyDegraded marks the drive while it doesn't respond and keeps the space it reported last,
+// which is better than none. It must be called with lock held.
+func applyDegraded(drive *Drive, previous *Drive) {
+	drive.Degraded, _ = drive.degraded()
+	if drive.Degraded && drive.TotalSize == 0 && previous != nil {
+		drive.AvailableFreeSpace = previous.AvailableFreeSpace
+		drive.TotalFreeSpace = previous.TotalFreeSpace
+		drive.TotalSize = previous.TotalSize
+		drive.BlockSize = previous.BlockSize
+		drive.TotalInodes = previous.TotalInodes
+		drive.FreeInodes = previous.FreeInodes
+	}
+}
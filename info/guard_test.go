@@ -0,0 +1,53 @@
+package info
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingReader never returns from Read until release is closed, like a read from a dead card.
+type blockingReader struct {
+	release chan struct{}
+}
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b.release
+	return 0, nil
+}
+
+func TestGuardReader(t *testing.T) {
+	breakersLock.Lock()
+	saved := guardConfig
+	breakersLock.Unlock()
+	SetGuardConfig(GuardConfig{Timeout: 50 * time.Millisecond, Threshold: 100, ProbeInterval: time.Hour})
+	t.Cleanup(func() { SetGuardConfig(saved) })
+	root := t.TempDir()
+
+	data, err := ioutil.ReadAll(GuardReader(root, strings.NewReader("photo")))
+	if err != nil || string(data) != "photo" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	stuck := blockingReader{release: make(chan struct{})}
+	defer close(stuck.release)
+	n, err := GuardReader(root, stuck).Read(make([]byte, 16))
+	if n != 0 || err != ErrUnresponsive {
+		t.Errorf("got %d, %v from a read that doesn't return", n, err)
+	}
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := ContextReader(ctx, strings.NewReader("photo"))
+	p := make([]byte, 2)
+	if n, err := r.Read(p); n != 2 || err != nil {
+		t.Errorf("got %d, %v before the cancel", n, err)
+	}
+	cancel()
+	if n, err := r.Read(p); n != 0 || err != context.Canceled {
+		t.Errorf("got %d, %v after the cancel", n, err)
+	}
+}
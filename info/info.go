@@ -1,70 +1,284 @@
 package info
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
+	"guptaspi/auth"
+	"guptaspi/metrics"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Drive struct {
-	Path               string `json:"path"`
-	VolumeLabel        string `json:"volume_label"`
-	AvailableFreeSpace uint64 `json:"available_free_space"`
-	TotalFreeSpace     uint64 `json:"total_free_space"`
-	TotalSize          uint64 `json:"total_size"`
+	// Id stays the same across remounts and is preferred over the label in routes
+	Id string `json:"id"`
+	// Kind is drive for discovered drives, directory or pool for volumes from the registry
+	Kind string `json:"kind"`
+	Uuid string `json:"uuid"`
+	Path string `json:"path"`
+	// Name is the kernel name of the device, like sda1, or the drive letter on Windows
+	Name               string   `json:"name"`
+	VolumeLabel        string   `json:"volume_label"`
+	AvailableFreeSpace uint64   `json:"available_free_space"`
+	TotalFreeSpace     uint64   `json:"total_free_space"`
+	TotalSize          uint64   `json:"total_size"`
+	FileSystemType     string   `json:"file_system_type"`
+	MountOptions       []string `json:"mount_options"`
+	// Device is the block device on Linux, or the source of network shares, and the remote path on Windows
+	Device string `json:"device"`
+	// Model and Serial identify the disk when its driver reports them
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	// BlockSize is the filesystem's block size, inodes are zero for filesystems without them
+	BlockSize   uint64 `json:"block_size"`
+	TotalInodes uint64 `json:"total_inodes"`
+	FreeInodes  uint64 `json:"free_inodes"`
+	// MountTime is when the server saw the volume being mounted, unset for volumes mounted before it started
+	MountTime *time.Time `json:"mount_time,omitempty"`
+	// ReadOnly is set when the volume is mounted read-only or configured to be
+	ReadOnly bool `json:"read_only"`
+	// Alert is the low space alert state, unset when no threshold applies to the volume
+	Alert *VolumeAlert `json:"alert,omitempty"`
+	// Health is the SMART health of the drive's disk, unset until it was read or if the disk has no SMART
+	Health *DiskHealth `json:"health,omitempty"`
+	// Degraded is set while calls to the volume time out, they fail with 503 until it responds again
+	Degraded bool `json:"degraded"`
+	// Ejecting is set from the start of an eject until it finishes or fails
+	Ejecting bool `json:"ejecting"`
+	// DisplayOrder comes from the registry, drives are listed by it and then by volume label
+	DisplayOrder int `json:"display_order"`
+	// Members are the Ids of the drives a pool spans, Policy decides which of them new files go to
+	Members []string `json:"members,omitempty"`
+	Policy  string   `json:"policy,omitempty"`
+
+	// members are the mounted drives of a pool, hidden ones included
+	members []*Drive
+	// majorMinor is the block device number from the mount table, used to find the drive's I/O statistics
+	majorMinor string
+	// device is what the eject command unmounts, the block device on Linux and the drive letter on Windows
+	device string
+}
+
+// MountData describes a mounted filesystem, see proc(5) for the meaning of the mountinfo fields.
+// Windows only fills in Device, MountPoint, FileSystemType and ReadWrite.
+type MountData struct {
+	MountId    uint64
+	ParentId   uint64
+	MajorMinor string
+	// Root is the directory of the filesystem that is mounted, "/" unless it's a bind mount or subvolume
+	Root           string
+	MountPoint     string
+	Options        []string
+	OptionalFields []string
+	FileSystemType string
+	Device         string
+	SuperOptions   []string
+	// ReadWrite is "ro" or "rw"
+	ReadWrite string
+}
+
+// fileSystemStats holds what createDrive needs besides the disk space
+type fileSystemStats struct {
+	blockSize  uint64
+	inodes     uint64
+	freeInodes uint64
 }
 
+var errTooSmall = errors.New("drive is smaller than the minimum size")
+
+// ErrReadOnly is returned when writing to a read-only volume.
+var ErrReadOnly = errors.New("volume is read-only")
+
+// driveMap holds the discovered drives by Id. Drives in it are never changed, as Drives and GetDrive hand them
+// out to readers that don't hold lock. refreshDrives swaps in new ones, updateDrive replaces them with a copy.
 var driveMap = map[string]*Drive{}
 var lock = sync.RWMutex{}
 
-func GetDrive(volumeLabel string) *Drive {
+// updateDrive replaces the drive with the given Id by a copy that apply changed. It must be called with lock held.
+func updateDrive(id string, apply func(drive *Drive)) {
+	current, ok := driveMap[id]
+	if !ok {
+		return
+	}
+	next := *current
+	apply(&next)
+	driveMap[id] = &next
+}
+
+var (
+	volumeSizeGauge = metrics.NewGaugeFunc(
+		"guptaspi_volume_size_bytes", "Total size of the volume.", volumeLabelNames,
+		volumeSamples(func(d *Drive) uint64 { return d.TotalSize }),
+	)
+	volumeAvailableGauge = metrics.NewGaugeFunc(
+		"guptaspi_volume_available_bytes", "Free space on the volume available to the server.", volumeLabelNames,
+		volumeSamples(func(d *Drive) uint64 { return d.AvailableFreeSpace }),
+	)
+	volumeFreeGauge = metrics.NewGaugeFunc(
+		"guptaspi_volume_free_bytes", "Total free space on the volume.", volumeLabelNames,
+		volumeSamples(func(d *Drive) uint64 { return d.TotalFreeSpace }),
+	)
+)
+
+var volumeLabelNames = []string{"id", "volume", "path"}
+
+func volumeSamples(value func(d *Drive) uint64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, drive := range Drives() {
+			samples = append(samples, metrics.Sample{
+				LabelValues: []string{drive.Id, drive.VolumeLabel, drive.Path},
+				Value:       float64(value(drive)),
+			})
+		}
+		return samples
+	}
+}
+
+// Drives returns the currently known drives ordered by display order and volume label.
+func Drives() []*Drive {
 	lock.RLock()
-	if len(driveMap) == 0 {
-		lock.RUnlock()
-		populateDriveMap()
+	drives := make([]*Drive, 0, len(driveMap))
+	for _, drive := range driveMap {
+		drives = append(drives, drive)
+	}
+	lock.RUnlock()
+
+	sort.Slice(drives, func(i, j int) bool {
+		if drives[i].DisplayOrder != drives[j].DisplayOrder {
+			return drives[i].DisplayOrder < drives[j].DisplayOrder
+		}
+		return drives[i].VolumeLabel < drives[j].VolumeLabel
+	})
+	return drives
+}
+
+// GetDrive finds a drive by its Id, or by its volume label or alias for older clients.
+// Hidden drives aren't found.
+func GetDrive(volume string) *Drive {
+	lock.RLock()
+	empty := len(driveMap) == 0
+	lock.RUnlock()
+	if empty {
+		refreshDrives()
 	}
 	lock.RLock()
 	defer lock.RUnlock()
-	return driveMap[volumeLabel]
+	if drive, ok := driveMap[volume]; ok {
+		return drive
+	}
+	for _, drive := range driveMap {
+		if drive.VolumeLabel == volume {
+			return drive
+		}
+	}
+	return nil
+}
+
+// CheckWritable returns ErrReadOnly if files on the drive can't be created, changed or deleted,
+// or ErrEjecting while it's being ejected. Every mutating operation should call it before touching the drive.
+func (d *Drive) CheckWritable() error {
+	if err := d.CheckAvailable(); err != nil {
+		return err
+	}
+	if d.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// hashId derives a short stable Id for drives without a filesystem UUID.
+func hashId(source string) string {
+	h := sha1.Sum([]byte(source))
+	return hex.EncodeToString(h[:6])
+}
+
+// disambiguate makes Ids and volume labels unique. Drives are ordered by path,
+// the first drive keeps a contested Id and every drive sharing a label gets its Id appended to it,
+// so the outcome doesn't depend on discovery order.
+func disambiguate(drives []*Drive) {
+	sort.Slice(drives, func(i, j int) bool {
+		return drives[i].Path < drives[j].Path
+	})
+
+	ids := map[string]int{}
+	for _, drive := range drives {
+		ids[drive.Id]++
+		if n := ids[drive.Id]; n > 1 {
+			// The same filesystem mounted twice, e.g. a bind mount
+			drive.Id = drive.Id + "-" + hashId(drive.Path)
+		}
+	}
+
+	labels := map[string]int{}
+	for _, drive := range drives {
+		labels[drive.VolumeLabel]++
+	}
+	for _, drive := range drives {
+		if labels[drive.VolumeLabel] > 1 {
+			drive.VolumeLabel = drive.VolumeLabel + "-" + drive.Id
+		}
+	}
 }
 
-func populateDriveMap() {
-	lock.Lock()
-	defer lock.Unlock()
-	for _, letter := range getNetworkDrives() {
-		if drive, err := createDrive(letter); err != nil {
-			continue
-		} else {
-			driveMap[drive.VolumeLabel] = drive
+// discoverDrives returns the mounts that match the discovery rules.
+func discoverDrives() []*MountData {
+	lock.RLock()
+	r := rules
+	lock.RUnlock()
+
+	var mounts []*MountData
+	for _, mount := range getMounts() {
+		if r.Match(mount) {
+			mounts = append(mounts, mount)
 		}
 	}
+	return mounts
+}
+
+// checkSize applies the minimum size rule to a drive.
+func checkSize(drive *Drive) error {
+	lock.RLock()
+	minSize := rules.MinSize
+	lock.RUnlock()
+
+	if minSize > 0 && drive.TotalSize < minSize {
+		return errTooSmall
+	}
+	return nil
 }
 
 // AddInfoRouter installs endpoints into main router located in server.go.
 // r is a pointer to that router
 func AddInfoRouter(r *mux.Router) {
 	r.HandleFunc("/info", getInfo).Methods("GET")
+	r.HandleFunc("/info/events", getEvents).Methods("GET")
+	r.HandleFunc("/info/system", getSystem).Methods("GET")
+	r.HandleFunc("/info/capacity/{volume}", getCapacity).Methods("GET")
+	r.HandleFunc("/info/io", getDiskIO).Methods("GET")
+	r.HandleFunc("/info/io/{volume}", getVolumeIO).Methods("GET")
+	r.Handle("/info/eject/{volume}", auth.AdminOnly(http.HandlerFunc(startEject))).Methods("POST")
+	r.HandleFunc("/info/eject/{volume}", getEject).Methods("GET")
+	r.Handle("/info/eject/{volume}", auth.AdminOnly(http.HandlerFunc(abortEject))).Methods("DELETE")
+
+	go watchDrives(context.TODO())
+	go recordSystemStats(context.TODO())
+	go recordCapacity(context.TODO())
+	go watchAlerts(context.TODO())
+	go recordDiskIO(context.TODO())
+	go watchHealth(context.TODO())
 }
 
 // getInfo corresponds to the GET /info endpoint.
 // This endpoint returns information on the network drives available to the server.
+// It serves the drives as the watcher last refreshed them, so a slow drive can't hold up the response.
 func getInfo(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-
-	networkDrives := getNetworkDrives()
-
-	lock.RLock()
-	if len(driveMap) != len(networkDrives) {
-		lock.RUnlock()
-		populateDriveMap()
-	}
-
-	lock.RLock()
-	defer lock.RUnlock()
-	var drives []*Drive
-	for _, drive := range driveMap {
-		drives = append(drives, drive)
-	}
-	_ = json.NewEncoder(w).Encode(drives)
+	_ = json.NewEncoder(w).Encode(Drives())
 }
@@ -3,91 +3,334 @@
 package info
 
 import (
+	"context"
 	"golang.org/x/sys/unix"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type MountData struct {
-	Device         string
-	MountPoint     string
-	FileSystemType string
-	ReadWrite      string
+// openMountTable opens the mount table drives are discovered from. Tests replace it to read fixture files.
+var openMountTable = func() (io.ReadCloser, error) {
+	return os.Open(mountInfoPath)
 }
 
-func createDrive(mountPoint string) (*Drive, error) {
-	volumeName := getVolumeName(mountPoint)
-	diskSpace, err := getDiskSpace(mountPoint)
-	if err != nil {
+// DefaultDiscoveryRules exposes disks with regular filesystems and network shares,
+// but none of the system, virtual or container mounts.
+func DefaultDiscoveryRules() DiscoveryRules {
+	return DiscoveryRules{
+		IncludeTypes: []string{
+			"fuseblk", "ext2", "ext3", "ext4", "btrfs", "xfs", "f2fs", "vfat", "exfat", "ntfs", "ntfs3", "hfsplus",
+			"nfs", "nfs4", "cifs", "smb3",
+		},
+		ExcludeTypes: []string{
+			"tmpfs", "devtmpfs", "ramfs", "proc", "sysfs", "cgroup", "cgroup2", "overlay", "squashfs", "autofs",
+			"devpts", "mqueue", "debugfs", "tracefs", "securityfs", "pstore", "bpf", "configfs", "fusectl", "hugetlbfs",
+		},
+		ExcludeMountPoints: []string{
+			"/", "/boot", "/boot/*", "/proc", "/proc/*", "/sys", "/sys/*", "/dev", "/dev/*", "/run",
+			"/etc/*", "/snap/*", "/var/lib/docker/*",
+		},
+		ExcludeDevices: []string{"/dev/loop*", "/dev/zram*"},
+	}
+}
+
+// defaultEjectCommand needs the server to be allowed to unmount, e.g. through a user mount in fstab.
+var defaultEjectCommand = []string{"umount", "{path}"}
+
+// devDiskPath is where udev links block devices by label and filesystem UUID. Tests point it at fixture directories.
+var devDiskPath = "/dev/disk"
+
+func createDrive(mount *MountData) (*Drive, error) {
+	// Unresponsive drives are still listed, refreshDrives fills in the space they reported last
+	diskSpace, stats, err := statFileSystem(mount.MountPoint)
+	if err != nil && err != ErrUnresponsive {
 		return nil, err
 	}
+	unresponsive := err == ErrUnresponsive
+
+	device := mount.Device
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+
+	volumeName, ok := diskLinks("by-label")[device]
+	if !ok {
+		volumeName = getVolumeName(mount.MountPoint)
+	}
 
-	return &Drive{
-		Path:               mountPoint,
+	// Devices without a filesystem UUID, like network shares, are identified by where they come from
+	uuid := diskLinks("by-uuid")[device]
+	var id string
+	switch {
+	case uuid == "":
+		id = hashId(mount.Device + "\x00" + mount.Root)
+	case mount.Root != "" && mount.Root != "/":
+		// Subvolumes and bind mounts of a filesystem share its UUID
+		id = uuid + "-" + hashId(mount.Root)
+	default:
+		id = uuid
+	}
+
+	// Network shares have no device node, their source is kept as the device
+	var name string
+	if strings.HasPrefix(device, "/dev/") {
+		name = filepath.Base(device)
+	}
+	model, serial := readDiskIdentity(systemRoot, mount.MajorMinor, device)
+
+	drive := &Drive{
+		Id:                 id,
+		Kind:               VolumeKindDrive,
+		Uuid:               uuid,
+		Path:               mount.MountPoint,
+		Name:               name,
 		VolumeLabel:        volumeName,
 		AvailableFreeSpace: diskSpace[0],
 		TotalFreeSpace:     diskSpace[1],
 		TotalSize:          diskSpace[2],
-	}, nil
+		FileSystemType:     mount.FileSystemType,
+		MountOptions:       mount.Options,
+		ReadOnly:           mount.ReadWrite == "ro" || hasOption(mount.SuperOptions, "ro"),
+		Device:             device,
+		Model:              model,
+		Serial:             serial,
+		BlockSize:          stats.blockSize,
+		TotalInodes:        stats.inodes,
+		FreeInodes:         stats.freeInodes,
+		majorMinor:         mount.MajorMinor,
+		device:             device,
+	}
+
+	if unresponsive {
+		return drive, nil
+	}
+	if err := checkSize(drive); err != nil {
+		return nil, err
+	}
+
+	return drive, nil
 }
 
 func getDiskSpace(mountPoint string) ([3]uint64, error) {
+	diskSpace, _, err := statFileSystem(mountPoint)
+	return diskSpace, err
+}
+
+// statFileSystem returns the disk space in the order of getDiskSpace along with the block size and inode counts
+// of the filesystem mounted at mountPoint, from a single statfs. Filesystems without inodes, like vfat and exfat,
+// report zero.
+func statFileSystem(mountPoint string) ([3]uint64, fileSystemStats, error) {
 	var stat unix.Statfs_t
 
-	err := unix.Statfs(mountPoint, &stat)
+	err := Guard(mountPoint, func() error { return unix.Statfs(mountPoint, &stat) })
 	if err != nil {
 		log.Printf("Error getting drive stats: %v", err)
-		return [3]uint64{0, 0, 0}, err
+		return [3]uint64{0, 0, 0}, fileSystemStats{}, err
 	}
 
 	bSize := uint64(stat.Bsize)
 
-	return [3]uint64{bSize * stat.Bavail, bSize * stat.Bfree, bSize * stat.Blocks}, nil
+	diskSpace := [3]uint64{bSize * stat.Bavail, bSize * stat.Bfree, bSize * stat.Blocks}
+	return diskSpace, fileSystemStats{blockSize: bSize, inodes: stat.Files, freeInodes: stat.Ffree}, nil
+}
+
+// readDiskIdentity reads the model and serial number of the disk holding the device from sysfs below root.
+// Either is empty when the driver doesn't report it, like for network shares. USB bridges often only
+// report the serial number on the USB device, a few levels above the disk, so the parents are searched too.
+func readDiskIdentity(root string, majorMinor string, node string) (model string, serial string) {
+	device, ok := resolveBlockDevice(root, majorMinor, node)
+	if !ok {
+		return "", ""
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, "sys/block", device.Disk, "device"))
+	if err != nil {
+		return "", ""
+	}
+
+	model = readSysfsValue(dir, "model")
+	if model == "" {
+		// MMC and SD cards report their model as name
+		model = readSysfsValue(dir, "name")
+	}
+	if vendor := readSysfsValue(dir, "vendor"); model != "" && vendor != "" && vendor != "ATA" && !strings.HasPrefix(model, vendor) {
+		model = strings.TrimSpace(vendor + " " + model)
+	}
+
+	devices := filepath.Join(root, "sys/devices")
+	for d := dir; strings.HasPrefix(d, devices+"/"); d = filepath.Dir(d) {
+		if serial = readSysfsValue(d, "serial"); serial != "" {
+			break
+		}
+	}
+	return model, serial
+}
+
+// smartDevice returns the disk smartctl reads the drive's health from, empty for drives without a block device.
+func smartDevice(drive *Drive) string {
+	if !strings.HasPrefix(drive.device, "/dev/") {
+		return ""
+	}
+	device, ok := resolveBlockDevice(systemRoot, drive.majorMinor, drive.device)
+	if !ok {
+		return ""
+	}
+	return "/dev/" + device.Disk
+}
+
+func readSysfsValue(dir string, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
 }
 
 func getVolumeName(mountPoint string) string {
 	return filepath.Base(mountPoint)
 }
 
-func getNetworkDrives() []string {
-	mounts := getDrives()
+// syncVolume flushes everything written to the filesystem mounted at mountPoint.
+func syncVolume(mountPoint string) error {
+	f, err := os.Open(mountPoint)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Syncfs(int(f.Fd()))
+}
+
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
 
-	var networkDrives []string
+// diskLinks maps resolved device paths to the names of their links in /dev/disk/<kind>.
+func diskLinks(kind string) map[string]string {
+	dir := filepath.Join(devDiskPath, kind)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
 
-	for _, mount := range mounts {
-		// Get NTFS drives
-		if mount.FileSystemType == "fuseblk" {
-			networkDrives = append(networkDrives, mount.MountPoint)
+	links := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
 		}
+		links[target] = unescapeUdev(entry.Name())
 	}
+	return links
+}
 
-	return networkDrives
+// unescapeUdev decodes the \xHH escapes udev uses for characters like spaces and slashes in link names.
+func unescapeUdev(name string) string {
+	if !strings.Contains(name, "\\x") {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+3 < len(name) && name[i+1] == 'x' {
+			if c, err := strconv.ParseUint(name[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
 }
 
-func getDrives() []*MountData {
-	data, err := ioutil.ReadFile("/proc/mounts")
+func getMounts() []*MountData {
+	f, err := openMountTable()
 	if err != nil {
 		log.Printf("Error reading mounts: %v", err)
 		return nil
 	}
+	defer f.Close()
 
-	mountStrings := strings.Split(string(data), "\n")
+	mounts, err := parseMountInfo(f)
+	if err != nil {
+		log.Printf("Error reading mounts: %v", err)
+		return nil
+	}
 
-	var mounts []*MountData
+	return mounts
+}
+
+// mountInfoPath is parsed for the mount table and watched for changes.
+var mountInfoPath = "/proc/self/mountinfo"
 
-	for _, mountString := range mountStrings {
-		mountData := strings.Split(mountString, " ")
-		if len(mountData) >= 4 {
-			mounts = append(mounts, &MountData{
-				Device:         mountData[0],
-				MountPoint:     mountData[1],
-				FileSystemType: mountData[2],
-				ReadWrite:      mountData[3],
-			})
+// mountPollInterval bounds how long a change can go unnoticed if the kernel notification is missed,
+// and how old the free space GET /info serves can get.
+const mountPollInterval = 10 * time.Second
+
+// watchMounts signals changes whenever the kernel reports that the mount table changed.
+// The kernel flags /proc/self/mountinfo with POLLPRI after every mount and unmount.
+func watchMounts(ctx context.Context, changes chan<- struct{}) {
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
 		}
 	}
 
-	return mounts
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		log.Printf("Error opening %s, falling back to polling: %v", mountInfoPath, err)
+		pollMounts(ctx, notify)
+		return
+	}
+	defer f.Close()
+
+	// Reading the file arms the notification
+	drain := func() {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			_, _ = io.Copy(ioutil.Discard, f)
+		}
+	}
+	drain()
+	notify()
+
+	fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLPRI}}
+	for ctx.Err() == nil {
+		n, err := unix.Poll(fds, int(mountPollInterval/time.Millisecond))
+		if err != nil && err != unix.EINTR {
+			log.Printf("Error polling %s, falling back to polling: %v", mountInfoPath, err)
+			pollMounts(ctx, notify)
+			return
+		}
+		if n > 0 {
+			drain()
+		}
+		// Timeouts also refresh, which keeps free space and sizes up to date
+		notify()
+	}
+}
+
+func pollMounts(ctx context.Context, notify func()) {
+	ticker := time.NewTicker(mountPollInterval)
+	defer ticker.Stop()
+
+	notify()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify()
+		}
+	}
 }
@@ -0,0 +1,170 @@
+// +build linux
+
+package info
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// diskFixture builds a /dev tree with udev's by-label and by-uuid links below a temporary directory
+// and points devDiskPath and systemRoot at it until the test ends.
+func diskFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+
+	links := map[string]string{
+		"by-label/My\\x20Passport": "sda1",
+		"by-label/DATA":            "sdb1",
+		"by-label/DATA\\x2fBACKUP": "sdc1",
+		"by-uuid/0A1B2C3D4E5F6071": "sda1",
+		"by-uuid/1234-ABCD":        "sdb1",
+		"by-uuid/5f1e0c2a-9d7b-4e": "sdc1",
+	}
+	for _, device := range []string{"sda1", "sdb1", "sdc1"} {
+		if err := ioutil.WriteFile(filepath.Join(root, device), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, device := range links {
+		path := filepath.Join(root, "disk", link)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		// udev links are relative, like ../../sda1
+		if err := os.Symlink(filepath.Join("..", "..", device), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	savedDevDisk, savedSystemRoot := devDiskPath, systemRoot
+	devDiskPath, systemRoot = filepath.Join(root, "disk"), root
+	t.Cleanup(func() {
+		devDiskPath, systemRoot = savedDevDisk, savedSystemRoot
+	})
+	return root
+}
+
+func TestDiskLinks(t *testing.T) {
+	root := diskFixture(t)
+
+	labels := diskLinks("by-label")
+	want := map[string]string{
+		filepath.Join(root, "sda1"): "My Passport",
+		filepath.Join(root, "sdb1"): "DATA",
+		filepath.Join(root, "sdc1"): "DATA/BACKUP",
+	}
+	if len(labels) != len(want) {
+		t.Errorf("got %q, want %q", labels, want)
+	}
+	for device, label := range want {
+		if labels[device] != label {
+			t.Errorf("label of %s is %q, want %q", device, labels[device], label)
+		}
+	}
+
+	devDiskPath = filepath.Join(root, "missing")
+	if links := diskLinks("by-label"); len(links) != 0 {
+		t.Errorf("got %q without a /dev/disk", links)
+	}
+}
+
+func TestUnescapeUdev(t *testing.T) {
+	tests := map[string]string{
+		"My\\x20Passport": "My Passport",
+		"A\\x2fB":         "A/B",
+		"plain":           "plain",
+		"bad\\xZZ":        "bad\\xZZ",
+		"short\\x2":       "short\\x2",
+	}
+	for in, want := range tests {
+		if got := unescapeUdev(in); got != want {
+			t.Errorf("unescapeUdev(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCreateDriveLabelsAndIds(t *testing.T) {
+	root := diskFixture(t)
+	mountPoint := t.TempDir()
+
+	tests := []struct {
+		name  string
+		mount MountData
+		id    string
+		uuid  string
+		label string
+	}{
+		{
+			name:  "label and uuid",
+			mount: MountData{Device: filepath.Join(root, "sda1"), Root: "/", FileSystemType: "fuseblk"},
+			id:    "0A1B2C3D4E5F6071",
+			uuid:  "0A1B2C3D4E5F6071",
+			label: "My Passport",
+		},
+		{
+			name:  "subvolume",
+			mount: MountData{Device: filepath.Join(root, "sdb1"), Root: "/@photos", FileSystemType: "btrfs"},
+			id:    "1234-ABCD-" + hashId("/@photos"),
+			uuid:  "1234-ABCD",
+			label: "DATA",
+		},
+		{
+			name:  "network share",
+			mount: MountData{Device: "//nas/Family Share", Root: "/", FileSystemType: "cifs"},
+			id:    hashId("//nas/Family Share\x00/"),
+			label: filepath.Base(mountPoint),
+		},
+	}
+	for _, test := range tests {
+		mount := test.mount
+		mount.MountPoint = mountPoint
+		drive, err := createDrive(&mount)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if drive.Id != test.id || drive.Uuid != test.uuid || drive.VolumeLabel != test.label {
+			t.Errorf("%s: got id %q uuid %q label %q, want %q %q %q", test.name,
+				drive.Id, drive.Uuid, drive.VolumeLabel, test.id, test.uuid, test.label)
+		}
+	}
+}
+
+func TestDisambiguate(t *testing.T) {
+	newDrives := func() []*Drive {
+		return []*Drive{
+			{Id: "1234-ABCD", Path: "/media/b/DATA", VolumeLabel: "DATA"},
+			{Id: "1234-ABCD", Path: "/media/a/DATA", VolumeLabel: "DATA"},
+			{Id: "0A1B2C3D4E5F6071", Path: "/media/pi/My Passport", VolumeLabel: "My Passport"},
+		}
+	}
+
+	first := newDrives()
+	disambiguate(first)
+	// The first path keeps the contested Id, both drives named DATA get their Id appended
+	want := map[string][2]string{
+		"/media/a/DATA":         {"1234-ABCD", "DATA-1234-ABCD"},
+		"/media/b/DATA":         {"1234-ABCD-" + hashId("/media/b/DATA"), "DATA-1234-ABCD-" + hashId("/media/b/DATA")},
+		"/media/pi/My Passport": {"0A1B2C3D4E5F6071", "My Passport"},
+	}
+	for _, drive := range first {
+		if got := [2]string{drive.Id, drive.VolumeLabel}; got != want[drive.Path] {
+			t.Errorf("%s: got %q, want %q", drive.Path, got, want[drive.Path])
+		}
+	}
+
+	// The outcome doesn't depend on the order drives were discovered in
+	reversed := newDrives()
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	disambiguate(reversed)
+	for i := range first {
+		if first[i].Id != reversed[i].Id || first[i].VolumeLabel != reversed[i].VolumeLabel {
+			t.Errorf("order changed the outcome: %+v and %+v", first[i], reversed[i])
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package info
+
+import "testing"
+
+func TestUpdateDriveCopies(t *testing.T) {
+	lock.Lock()
+	saved := driveMap
+	driveMap = map[string]*Drive{"usb": {Id: "usb", VolumeLabel: "USB"}}
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		driveMap = saved
+		lock.Unlock()
+	})
+
+	before := GetDrive("usb")
+	lock.Lock()
+	updateDrive("usb", func(drive *Drive) { drive.Ejecting = true })
+	updateDrive("missing", func(drive *Drive) { t.Error("updated a drive that doesn't exist") })
+	lock.Unlock()
+
+	// Whoever got the drive before keeps an unchanged copy
+	if before.Ejecting {
+		t.Error("the drive handed out before was changed")
+	}
+	if after := GetDrive("usb"); after == before || !after.Ejecting || after.VolumeLabel != "USB" {
+		t.Errorf("got %+v after the update", after)
+	}
+}
+
+func TestSetReadOnlyVolumesCopies(t *testing.T) {
+	usb := &Drive{Id: "usb", VolumeLabel: "USB"}
+	pool := &Drive{Id: "photos", Kind: VolumeKindPool, members: []*Drive{usb}}
+	lock.Lock()
+	saved, savedVolumes := driveMap, readOnlyVolumes
+	driveMap = map[string]*Drive{"usb": usb, "photos": pool}
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		driveMap, readOnlyVolumes = saved, savedVolumes
+		lock.Unlock()
+	})
+
+	SetReadOnlyVolumes([]string{"USB"})
+
+	if usb.ReadOnly || pool.ReadOnly {
+		t.Error("the drives handed out before were changed")
+	}
+	if !GetDrive("usb").ReadOnly {
+		t.Error("the drive wasn't marked read-only")
+	}
+	if updated := GetDrive("photos"); !updated.ReadOnly || updated.members[0] != GetDrive("usb") {
+		t.Errorf("got %+v for the pool", updated)
+	}
+}
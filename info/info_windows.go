@@ -3,31 +3,84 @@
 package info
 
 import (
+	"context"
+	"fmt"
 	"golang.org/x/sys/windows"
+	"sync"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
-// createDrive creates a Drive pointer from a drive letter.
+var (
+	kernel32              = windows.NewLazySystemDLL("kernel32.dll")
+	mpr                   = windows.NewLazySystemDLL("mpr.dll")
+	procGetDiskFreeSpace  = kernel32.NewProc("GetDiskFreeSpaceW")
+	procWNetGetConnection = mpr.NewProc("WNetGetConnectionW")
+)
+
+// DefaultDiscoveryRules accepts every network drive.
+func DefaultDiscoveryRules() DiscoveryRules {
+	return DiscoveryRules{}
+}
+
+// defaultEjectCommand disconnects the network drive.
+var defaultEjectCommand = []string{"net", "use", "{device}:", "/delete", "/y"}
+
+// createDrive creates a Drive pointer from a mounted network drive.
 // Returns error in second argument if there was an error getting information
-func createDrive(letter string) (*Drive, error) {
-	rootPath := letter + ":\\"
-	volumeName, err := getVolumeName(rootPath)
+func createDrive(mount *MountData) (*Drive, error) {
+	rootPath := mount.MountPoint
+	volume, err := getVolumeInformation(rootPath)
 	if err != nil {
 		return nil, err
 	}
 
-	diskSpace, err := getDiskSpace(rootPath)
-	if err != nil {
+	// Unresponsive drives are still listed, refreshDrives fills in the space they reported last
+	diskSpace, stats, err := statFileSystem(rootPath)
+	if err != nil && err != ErrUnresponsive {
 		return nil, err
 	}
+	unresponsive := err == ErrUnresponsive
+
+	// The serial number is written when the volume is formatted, unlike the drive letter it survives remapping
+	var uuid string
+	id := hashId(rootPath)
+	if volume.SerialNumber != 0 {
+		uuid = fmt.Sprintf("%04X-%04X", volume.SerialNumber>>16, volume.SerialNumber&0xFFFF)
+		id = uuid
+	}
 
-	return &Drive{
+	drive := &Drive{
+		Id:                 id,
+		Kind:               VolumeKindDrive,
+		Uuid:               uuid,
 		Path:               rootPath,
-		VolumeLabel:        volumeName,
+		Name:               mount.Device,
+		VolumeLabel:        volume.Name,
 		AvailableFreeSpace: diskSpace[0],
 		TotalFreeSpace:     diskSpace[1],
 		TotalSize:          diskSpace[2],
-	}, nil
+		FileSystemType:     volume.FileSystemName,
+		ReadOnly:           volume.Flags&windows.FILE_READ_ONLY_VOLUME != 0,
+		Device:             getRemoteName(mount.Device),
+		BlockSize:          stats.blockSize,
+		device:             mount.Device,
+	}
+
+	if unresponsive {
+		return drive, nil
+	}
+	if err := checkSize(drive); err != nil {
+		return nil, err
+	}
+
+	return drive, nil
+}
+
+// syncVolume has nothing to flush, network drives write through to the server.
+func syncVolume(_ string) error {
+	return nil
 }
 
 // getDiskSpace returns an array of three items in the following order:
@@ -43,12 +96,14 @@ func getDiskSpace(rootPathName string) ([3]uint64, error) {
 	var totalSpace uint64
 	var totalFreeSpace uint64
 
-	err = windows.GetDiskFreeSpaceEx(
-		rootPathNamePtr,
-		&availableFreeSpace,
-		&totalSpace,
-		&totalFreeSpace,
-	)
+	err = Guard(rootPathName, func() error {
+		return windows.GetDiskFreeSpaceEx(
+			rootPathNamePtr,
+			&availableFreeSpace,
+			&totalSpace,
+			&totalFreeSpace,
+		)
+	})
 
 	if err != nil {
 		return [3]uint64{0, 0, 0}, err
@@ -57,12 +112,110 @@ func getDiskSpace(rootPathName string) ([3]uint64, error) {
 	return [3]uint64{availableFreeSpace, totalFreeSpace, totalSpace}, nil
 }
 
-// getVolumeName gets the Volume Name of the drive located at the root path.
-// Returns error in second argument if unable to get information.
-func getVolumeName(rootPathName string) (string, error) {
+// statFileSystem returns the disk space in the order of getDiskSpace along with the block size of the volume.
+// Windows reports them through separate calls, the second is skipped when the first fails.
+func statFileSystem(rootPathName string) ([3]uint64, fileSystemStats, error) {
+	diskSpace, err := getDiskSpace(rootPathName)
+	if err != nil {
+		return diskSpace, fileSystemStats{}, err
+	}
+	stats, err := getFileSystemStats(rootPathName)
+	return diskSpace, stats, err
+}
+
+// getFileSystemStats returns the cluster size of the volume at the root path as block size.
+// Windows doesn't report inodes.
+func getFileSystemStats(rootPathName string) (fileSystemStats, error) {
 	rootPathNamePtr, err := syscall.UTF16PtrFromString(rootPathName)
 	if err != nil {
-		return "", err
+		return fileSystemStats{}, err
+	}
+
+	var sectorsPerCluster, bytesPerSector, freeClusters, totalClusters uint32
+	err = Guard(rootPathName, func() error {
+		r, _, err := procGetDiskFreeSpace.Call(
+			uintptr(unsafe.Pointer(rootPathNamePtr)),
+			uintptr(unsafe.Pointer(&sectorsPerCluster)),
+			uintptr(unsafe.Pointer(&bytesPerSector)),
+			uintptr(unsafe.Pointer(&freeClusters)),
+			uintptr(unsafe.Pointer(&totalClusters)),
+		)
+		if r == 0 {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fileSystemStats{}, err
+	}
+
+	return fileSystemStats{blockSize: uint64(sectorsPerCluster) * uint64(bytesPerSector)}, nil
+}
+
+// smartDevice returns no disk, network drives have no SMART.
+func smartDevice(_ *Drive) string {
+	return ""
+}
+
+// getRemoteName returns the UNC path the drive letter is mapped to, or an empty string if it is unknown.
+func getRemoteName(letter string) string {
+	localName, err := syscall.UTF16PtrFromString(letter + ":")
+	if err != nil {
+		return ""
+	}
+
+	buffer := make([]uint16, 1024)
+	size := uint32(len(buffer))
+	r, _, _ := procWNetGetConnection.Call(
+		uintptr(unsafe.Pointer(localName)),
+		uintptr(unsafe.Pointer(&buffer[0])),
+		uintptr(unsafe.Pointer(&size)),
+	)
+	if r != 0 {
+		return ""
+	}
+	return syscall.UTF16ToString(buffer)
+}
+
+type volumeInformation struct {
+	Name           string
+	FileSystemName string
+	SerialNumber   uint32
+	Flags          uint32
+}
+
+// volumeInformationCache holds the last volume information of every root, so drives that stop responding
+// keep their id and label. It is guarded by volumeInformationLock.
+var volumeInformationCache = map[string]*volumeInformation{}
+var volumeInformationLock = sync.Mutex{}
+
+// getVolumeInformation gets the Volume Name, file system name, serial number and file system flags
+// of the drive located at the root path. A drive that doesn't respond gets the information it had last.
+func getVolumeInformation(rootPathName string) (*volumeInformation, error) {
+	var volume *volumeInformation
+	err := Guard(rootPathName, func() (err error) {
+		volume, err = queryVolumeInformation(rootPathName)
+		return err
+	})
+
+	volumeInformationLock.Lock()
+	defer volumeInformationLock.Unlock()
+	if err == ErrUnresponsive {
+		if cached, ok := volumeInformationCache[rootPathName]; ok {
+			return cached, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	volumeInformationCache[rootPathName] = volume
+	return volume, nil
+}
+
+func queryVolumeInformation(rootPathName string) (*volumeInformation, error) {
+	rootPathNamePtr, err := syscall.UTF16PtrFromString(rootPathName)
+	if err != nil {
+		return nil, err
 	}
 
 	var volumeNameBuffer = make([]uint16, syscall.MAX_PATH+1)
@@ -85,16 +238,40 @@ func getVolumeName(rootPathName string) (string, error) {
 	)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	//fmt.Printf("%s\n", syscall.UTF16ToString(volumeNameBuffer))
-	//fmt.Printf("%d\n", volumeSerialNumber)
-	//fmt.Printf("%d\n", maximumComponentLength)
-	//fmt.Printf("%b\n", fileSystemFlags)
-	//fmt.Printf("%s\n", syscall.UTF16ToString(fileSystemNameBuffer))
+	return &volumeInformation{
+		Name:           syscall.UTF16ToString(volumeNameBuffer),
+		FileSystemName: syscall.UTF16ToString(fileSystemNameBuffer),
+		SerialNumber:   volumeSerialNumber,
+		Flags:          fileSystemFlags,
+	}, nil
+}
+
+// getMounts returns the mount data of all network drives.
+func getMounts() []*MountData {
+	var mounts []*MountData
+
+	for _, letter := range getNetworkDrives() {
+		rootPath := letter + ":\\"
+		volume, err := getVolumeInformation(rootPath)
+		if err != nil {
+			continue
+		}
+		readWrite := "rw"
+		if volume.Flags&windows.FILE_READ_ONLY_VOLUME != 0 {
+			readWrite = "ro"
+		}
+		mounts = append(mounts, &MountData{
+			Device:         letter,
+			MountPoint:     rootPath,
+			FileSystemType: volume.FileSystemName,
+			ReadWrite:      readWrite,
+		})
+	}
 
-	return syscall.UTF16ToString(volumeNameBuffer), nil
+	return mounts
 }
 
 // getNetworkDrives returns list of drive letters of all network drives.
@@ -141,3 +318,25 @@ func bitsToDrives(bitMap uint32) (drives []string) {
 
 	return
 }
+
+// drivePollInterval is how often network drives are rediscovered.
+const drivePollInterval = 10 * time.Second
+
+// watchMounts signals changes periodically, Windows has no mount table to wait on.
+func watchMounts(ctx context.Context, changes chan<- struct{}) {
+	ticker := time.NewTicker(drivePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package info
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseMountInfo parses the format of /proc/<pid>/mountinfo, documented in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// Lines that can't be parsed are skipped.
+func parseMountInfo(r io.Reader) ([]*MountData, error) {
+	var mounts []*MountData
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		mount, err := parseMountInfoLine(line)
+		if err != nil {
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+
+	return mounts, scanner.Err()
+}
+
+func parseMountInfoLine(line string) (*MountData, error) {
+	fields := strings.Fields(line)
+
+	// The optional fields end with a single hyphen, which is followed by three more fields
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator == -1 || len(fields) < separator+3 {
+		return nil, fmt.Errorf("malformed mountinfo line %q", line)
+	}
+
+	mountId, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed mount id in %q", line)
+	}
+	parentId, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed parent id in %q", line)
+	}
+
+	mount := &MountData{
+		MountId:        mountId,
+		ParentId:       parentId,
+		MajorMinor:     fields[2],
+		Root:           unescapeOctal(fields[3]),
+		MountPoint:     unescapeOctal(fields[4]),
+		Options:        strings.Split(fields[5], ","),
+		OptionalFields: fields[6:separator],
+		FileSystemType: unescapeOctal(fields[separator+1]),
+		Device:         unescapeOctal(fields[separator+2]),
+	}
+	if len(fields) > separator+3 {
+		mount.SuperOptions = strings.Split(fields[separator+3], ",")
+	}
+
+	mount.ReadWrite = "rw"
+	for _, option := range mount.Options {
+		if option == "ro" {
+			mount.ReadWrite = "ro"
+		}
+	}
+
+	return mount, nil
+}
+
+// unescapeOctal decodes the \ooo escapes the kernel uses for spaces, tabs, newlines and backslashes.
+func unescapeOctal(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
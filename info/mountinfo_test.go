@@ -0,0 +1,211 @@
+package info
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readMountInfoFixture(t *testing.T, name string) []*MountData {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "mountinfo", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mounts, err := parseMountInfo(f)
+	if err != nil {
+		t.Fatalf("parseMountInfo(%s): %v", name, err)
+	}
+	return mounts
+}
+
+func mountsByPoint(mounts []*MountData) map[string]*MountData {
+	byPoint := make(map[string]*MountData, len(mounts))
+	for _, mount := range mounts {
+		byPoint[mount.MountPoint] = mount
+	}
+	return byPoint
+}
+
+func TestParseMountInfoRaspberryPi(t *testing.T) {
+	mounts := readMountInfoFixture(t, "raspberrypi.txt")
+	if len(mounts) != 11 {
+		t.Fatalf("got %d mounts, want 11", len(mounts))
+	}
+
+	passport := mountsByPoint(mounts)["/media/pi/My Passport"]
+	if passport == nil {
+		t.Fatalf("NTFS label with a space wasn't decoded, mount points: %v", mountPoints(mounts))
+	}
+	want := &MountData{
+		MountId:        126,
+		ParentId:       21,
+		MajorMinor:     "8:1",
+		Root:           "/",
+		MountPoint:     "/media/pi/My Passport",
+		Options:        []string{"rw", "nosuid", "nodev", "relatime"},
+		OptionalFields: []string{"shared:66"},
+		FileSystemType: "fuseblk",
+		Device:         "/dev/sda1",
+		SuperOptions:   []string{"rw", "user_id=0", "group_id=0", "default_permissions", "allow_other", "blksize=4096"},
+		ReadWrite:      "rw",
+	}
+	if !reflect.DeepEqual(passport, want) {
+		t.Errorf("got %+v\nwant %+v", passport, want)
+	}
+}
+
+func TestParseMountInfoOctalEscapes(t *testing.T) {
+	byPoint := mountsByPoint(readMountInfoFixture(t, "raspberrypi.txt"))
+
+	tests := []struct {
+		mountPoint string
+		device     string
+		readWrite  string
+	}{
+		{"/media/pi/My Passport", "/dev/sda1", "rw"},
+		{"/media/pi/Photos  2019", "/dev/sdb1", "ro"},
+		{"/media/pi/Tab\tName", "/dev/sdc1", "rw"},
+		{"/media/pi/Back\\slash", "/dev/sdd1", "rw"},
+		{"/mnt/nas", "//nas/Family Share", "rw"},
+	}
+	for _, test := range tests {
+		mount := byPoint[test.mountPoint]
+		if mount == nil {
+			t.Errorf("%q missing", test.mountPoint)
+			continue
+		}
+		if mount.Device != test.device {
+			t.Errorf("%q: device %q, want %q", test.mountPoint, mount.Device, test.device)
+		}
+		if mount.ReadWrite != test.readWrite {
+			t.Errorf("%q: read-write %q, want %q", test.mountPoint, mount.ReadWrite, test.readWrite)
+		}
+	}
+}
+
+func TestParseMountInfoOptionalFields(t *testing.T) {
+	byPoint := mountsByPoint(readMountInfoFixture(t, "btrfs.txt"))
+
+	tests := []struct {
+		mountPoint     string
+		optionalFields []string
+	}{
+		{"/srv/pool", []string{"shared:50"}},
+		{"/srv/photos", []string{"shared:51", "master:12"}},
+		{"/srv/readonly", []string{"unbindable"}},
+	}
+	for _, test := range tests {
+		mount := byPoint[test.mountPoint]
+		if mount == nil {
+			t.Errorf("%q missing", test.mountPoint)
+			continue
+		}
+		if !reflect.DeepEqual(mount.OptionalFields, test.optionalFields) {
+			t.Errorf("%q: optional fields %q, want %q", test.mountPoint, mount.OptionalFields, test.optionalFields)
+		}
+	}
+
+	// Lines without optional fields have the separator right after the options
+	mount, err := parseMountInfoLine("36 35 98:0 /mnt1 /mnt2 rw,noatime - ext3 /dev/root rw,errors=continue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mount.OptionalFields) != 0 || mount.FileSystemType != "ext3" || mount.Device != "/dev/root" {
+		t.Errorf("got %+v", mount)
+	}
+}
+
+func TestParseMountInfoBindMountsAndSubvolumes(t *testing.T) {
+	byPoint := mountsByPoint(readMountInfoFixture(t, "btrfs.txt"))
+
+	tests := []struct {
+		mountPoint string
+		majorMinor string
+		root       string
+		readWrite  string
+	}{
+		// btrfs reports an anonymous device number, the subvolume is in the root
+		{"/", "0:26", "/@", "rw"},
+		{"/home", "0:26", "/@home", "rw"},
+		{"/srv/pool", "0:48", "/", "rw"},
+		{"/srv/photos", "0:48", "/@photos", "rw"},
+		// A bind mount shares the device of the mount it was taken from, only the root differs
+		{"/srv/data", "8:33", "/", "rw"},
+		{"/srv/nfs/share", "8:33", "/exports/share", "rw"},
+		{"/srv/readonly", "8:33", "/exports/share", "ro"},
+	}
+	for _, test := range tests {
+		mount := byPoint[test.mountPoint]
+		if mount == nil {
+			t.Errorf("%q missing", test.mountPoint)
+			continue
+		}
+		if mount.MajorMinor != test.majorMinor || mount.Root != test.root || mount.ReadWrite != test.readWrite {
+			t.Errorf("%q: got %s %s %s, want %s %s %s", test.mountPoint,
+				mount.MajorMinor, mount.Root, mount.ReadWrite, test.majorMinor, test.root, test.readWrite)
+		}
+	}
+
+	want := []string{"rw", "space_cache=v2", "subvolid=260", "subvol=/@photos"}
+	if options := byPoint["/srv/photos"].SuperOptions; !reflect.DeepEqual(options, want) {
+		t.Errorf("super options %q, want %q", options, want)
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	mounts := readMountInfoFixture(t, "malformed.txt")
+
+	var got []string
+	for _, mount := range mounts {
+		got = append(got, mount.MountPoint)
+	}
+	want := []string{"/mnt2", "/no/super/options", "/dangling\\04"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %q, want %q", got, want)
+	}
+	if options := mountsByPoint(mounts)["/no/super/options"].SuperOptions; options != nil {
+		t.Errorf("super options %q, want none", options)
+	}
+
+	for _, line := range []string{
+		"this is not a mount",
+		"37 35 98:1 / /no/separator rw,noatime shared:1 ext4 /dev/sda1 rw",
+		"x 35 98:2 / /bad/id rw - ext4 /dev/sda2 rw",
+		"38 y 98:3 / /bad/parent rw - ext4 /dev/sda3 rw",
+		"39 35 98:4 / /truncated rw - ext4",
+	} {
+		if _, err := parseMountInfoLine(line); err == nil {
+			t.Errorf("parseMountInfoLine(%q) succeeded", line)
+		}
+	}
+}
+
+func TestUnescapeOctal(t *testing.T) {
+	tests := map[string]string{
+		"/media/pi/My\\040Passport": "/media/pi/My Passport",
+		"a\\011b":                   "a\tb",
+		"a\\012b":                   "a\nb",
+		"a\\134b":                   "a\\b",
+		"\\040\\040":                "  ",
+		"no escapes":                "no escapes",
+		"trailing\\04":              "trailing\\04",
+		"not\\octal\\999":           "not\\octal\\999",
+	}
+	for in, want := range tests {
+		if got := unescapeOctal(in); got != want {
+			t.Errorf("unescapeOctal(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func mountPoints(mounts []*MountData) []string {
+	points := make([]string, len(mounts))
+	for i, mount := range mounts {
+		points[i] = mount.MountPoint
+	}
+	return points
+}
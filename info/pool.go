@@ -0,0 +1,201 @@
+package info
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// PoolPolicyMostFree places new files on the member with the most available space
+	PoolPolicyMostFree = "most-free"
+	// PoolPolicyExistingPath places new files on a member that already has their folder,
+	// picking the one with the most available space if several do and falling back to most-free if none does
+	PoolPolicyExistingPath = "existing-path"
+	// PoolPolicyRoundRobin places new files on the members in turn, skipping those without enough space
+	PoolPolicyRoundRobin = "round-robin"
+)
+
+// ErrNoSpace is returned when no drive of a volume has room for a new file.
+var ErrNoSpace = errors.New("no drive of the volume has enough space")
+
+// roundRobin holds the index of the member the next file of each round-robin pool goes to
+var roundRobin = map[string]int{}
+var roundRobinLock = sync.Mutex{}
+
+func validPoolPolicy(policy string) bool {
+	switch policy {
+	case PoolPolicyMostFree, PoolPolicyExistingPath, PoolPolicyRoundRobin:
+		return true
+	}
+	return false
+}
+
+// createPoolDrive creates the drive of a pool from those of its members that are mounted.
+// Capacity is the sum over the members, which are expected to be separate filesystems.
+func createPoolDrive(entry VolumeEntry, drives map[string]*Drive) (*Drive, error) {
+	pool := &Drive{
+		Id:          entry.Id,
+		Kind:        VolumeKindPool,
+		VolumeLabel: entry.Id,
+		Members:     entry.Members,
+		Policy:      entry.Policy,
+	}
+	if pool.Policy == "" {
+		pool.Policy = PoolPolicyMostFree
+	}
+	for _, id := range entry.Members {
+		member, ok := drives[id]
+		if !ok {
+			continue
+		}
+		pool.members = append(pool.members, member)
+		pool.AvailableFreeSpace += member.AvailableFreeSpace
+		pool.TotalFreeSpace += member.TotalFreeSpace
+		pool.TotalSize += member.TotalSize
+		pool.TotalInodes += member.TotalInodes
+		pool.FreeInodes += member.FreeInodes
+	}
+	if len(pool.members) == 0 {
+		return nil, errors.New("no member of the pool is mounted")
+	}
+	return pool, nil
+}
+
+// applyPoolReadOnly marks a pool read-only when all of its members are. It must be called with lock held,
+// after applyReadOnly has run for the members.
+func applyPoolReadOnly(pool *Drive) {
+	if len(pool.members) == 0 {
+		return
+	}
+	for _, member := range pool.members {
+		if !member.ReadOnly {
+			return
+		}
+	}
+	pool.ReadOnly = true
+}
+
+// Roots returns the directories holding the volume's files, one per member for pools.
+func (d *Drive) Roots() []string {
+	if d.Kind != VolumeKindPool {
+		return []string{d.Path}
+	}
+	roots := make([]string, len(d.members))
+	for i, member := range d.members {
+		roots[i] = member.Path
+	}
+	return roots
+}
+
+// Locate returns the absolute path of a file on the volume. On pools that's the first member having it,
+// or the first member if none does.
+func (d *Drive) Locate(relativePath string) string {
+	_, path := d.LocateDrive(relativePath)
+	return path
+}
+
+// LocateDrive is Locate that also returns the drive the file is on, the volume itself unless it's a pool.
+func (d *Drive) LocateDrive(relativePath string) (*Drive, string) {
+	if d.Kind != VolumeKindPool {
+		return d, filepath.Join(d.Path, relativePath)
+	}
+	for _, member := range d.members {
+		path := filepath.Join(member.Path, relativePath)
+		if exists(member.Path, path) {
+			return member, path
+		}
+	}
+	return d.members[0], filepath.Join(d.members[0].Path, relativePath)
+}
+
+// PlaceFile picks the drive a new file at relativePath goes to, the volume itself unless it's a pool.
+// A file that already exists on a member stays there, so overwriting it doesn't leave a second copy behind.
+func (d *Drive) PlaceFile(relativePath string, size uint64) (*Drive, error) {
+	if d.Kind != VolumeKindPool {
+		return d, d.CheckWritable()
+	}
+	if err := d.CheckAvailable(); err != nil {
+		return nil, err
+	}
+
+	var candidates []*Drive
+	var space []uint64
+	var withPath []int
+	var lastErr error = ErrNoSpace
+	for _, member := range d.members {
+		if exists(member.Path, filepath.Join(member.Path, relativePath)) {
+			return member, member.CheckWritable()
+		}
+		if err := member.CheckWritable(); err != nil {
+			lastErr = err
+			continue
+		}
+		diskSpace, err := getDiskSpace(member.Path)
+		if err != nil || diskSpace[0] < size {
+			continue
+		}
+		if exists(member.Path, filepath.Join(member.Path, filepath.Dir(relativePath))) {
+			withPath = append(withPath, len(candidates))
+		}
+		candidates = append(candidates, member)
+		space = append(space, diskSpace[0])
+	}
+	if len(candidates) == 0 {
+		return nil, lastErr
+	}
+
+	switch d.Policy {
+	case PoolPolicyRoundRobin:
+		roundRobinLock.Lock()
+		next := roundRobin[d.Id] % len(candidates)
+		roundRobin[d.Id] = next + 1
+		roundRobinLock.Unlock()
+		return candidates[next], nil
+	case PoolPolicyExistingPath:
+		if len(withPath) > 0 {
+			best := withPath[0]
+			for _, i := range withPath[1:] {
+				if space[i] > space[best] {
+					best = i
+				}
+			}
+			return candidates[best], nil
+		}
+	}
+
+	best := 0
+	for i := range candidates[1:] {
+		if space[i+1] > space[best] {
+			best = i + 1
+		}
+	}
+	return candidates[best], nil
+}
+
+// exists reports whether path, below root, exists. A member that doesn't respond has nothing.
+func exists(root string, path string) bool {
+	return Guard(root, func() error {
+		_, err := os.Lstat(path)
+		return err
+	}) == nil
+}
+
+// diskSpace returns the space of the volume in the order of getDiskSpace, summed over the members of pools.
+func (d *Drive) diskSpace() ([3]uint64, error) {
+	if d.Kind != VolumeKindPool {
+		return getDiskSpace(d.Path)
+	}
+	var total [3]uint64
+	for _, root := range d.Roots() {
+		space, err := getDiskSpace(root)
+		if err != nil {
+			return total, err
+		}
+		for i := range total {
+			total[i] += space[i]
+		}
+	}
+	return total, nil
+}
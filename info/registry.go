@@ -0,0 +1,207 @@
+package info
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// VolumeKindDrive entries configure a discovered drive, their Id is the drive's
+	VolumeKindDrive = "drive"
+	// VolumeKindDirectory entries define a volume backed by a directory
+	VolumeKindDirectory = "directory"
+	// VolumeKindPool entries define a volume spanning the drives listed in Members
+	VolumeKindPool = "pool"
+)
+
+// VolumeEntry configures a volume in the registry.
+type VolumeEntry struct {
+	Id   string `json:"id"`
+	Kind string `json:"kind"`
+	// Path is the directory of directory volumes
+	Path string `json:"path,omitempty"`
+	// Alias replaces the volume label when set
+	Alias string `json:"alias"`
+	// Hidden volumes are left out of /info and can't be accessed
+	Hidden       bool `json:"hidden"`
+	DisplayOrder int  `json:"display_order"`
+	// Members are the drive Ids of a pool, hiding them keeps them out of /info but not out of the pool
+	Members []string `json:"members,omitempty"`
+	// Policy is one of the PoolPolicy constants, most-free if unset
+	Policy string `json:"policy,omitempty"`
+}
+
+// registry holds the volume entries by Id. It is guarded by lock.
+var registry = map[string]VolumeEntry{}
+
+// SetVolumeRegistry replaces the registry and applies it to the drives right away.
+func SetVolumeRegistry(entries []VolumeEntry) {
+	next := make(map[string]VolumeEntry, len(entries))
+	for _, entry := range entries {
+		next[entry.Id] = entry
+	}
+
+	lock.Lock()
+	registry = next
+	lock.Unlock()
+
+	refreshDrives()
+}
+
+// Validate checks an entry before it is stored. Pools are also checked against the pools in the registry.
+func (e VolumeEntry) Validate() error {
+	if e.Id == "" || len(e.Id) > 64 {
+		return errors.New("id must be between 1 and 64 characters")
+	}
+	for _, c := range e.Id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return errors.New("id may only contain letters, digits, - and _")
+		}
+	}
+
+	if e.Kind != VolumeKindPool && (len(e.Members) > 0 || e.Policy != "") {
+		return errors.New("only pools have members and a policy")
+	}
+
+	switch e.Kind {
+	case VolumeKindDrive:
+		if e.Path != "" {
+			return errors.New("drive volumes have no path")
+		}
+	case VolumeKindPool:
+		if e.Path != "" {
+			return errors.New("pool volumes have no path")
+		}
+		if len(e.Members) == 0 {
+			return errors.New("pools need at least one member")
+		}
+		for i, member := range e.Members {
+			if member == "" || member == e.Id || strings.Contains(member, ",") {
+				return fmt.Errorf("invalid member %q", member)
+			}
+			for _, other := range e.Members[:i] {
+				if other == member {
+					return fmt.Errorf("member %q is listed twice", member)
+				}
+			}
+		}
+		if e.Policy != "" && !validPoolPolicy(e.Policy) {
+			return fmt.Errorf("unknown policy %q", e.Policy)
+		}
+		// Pools only span drives and directories, a pool listed as member would never be mounted in it
+		lock.RLock()
+		defer lock.RUnlock()
+		for _, member := range e.Members {
+			if other, ok := registry[member]; ok && other.Kind == VolumeKindPool {
+				return fmt.Errorf("member %q is a pool, pools can't contain pools", member)
+			}
+		}
+		for _, other := range registry {
+			if other.Kind != VolumeKindPool || other.Id == e.Id {
+				continue
+			}
+			for _, member := range other.Members {
+				if member == e.Id {
+					return fmt.Errorf("pool %q has %q as member, pools can't contain pools", other.Id, e.Id)
+				}
+			}
+		}
+	case VolumeKindDirectory:
+		if !filepath.IsAbs(e.Path) {
+			return errors.New("path must be absolute")
+		}
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			return fmt.Errorf("path can't be used: %v", err)
+		}
+		if !info.IsDir() {
+			return errors.New("path is not a directory")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", e.Kind)
+	}
+
+	return nil
+}
+
+// createDirectoryDrive creates the drive of a directory volume. Directories are mounted wherever
+// their filesystem is, so only the space of that filesystem is known.
+func createDirectoryDrive(entry VolumeEntry) (*Drive, error) {
+	// A directory that doesn't respond is still listed, like unresponsive mounts
+	var info os.FileInfo
+	err := Guard(entry.Path, func() (err error) {
+		info, err = os.Stat(entry.Path)
+		return err
+	})
+	if err != nil && err != ErrUnresponsive {
+		return nil, err
+	}
+	if info != nil && !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", entry.Path)
+	}
+
+	diskSpace, stats, err := statFileSystem(entry.Path)
+	if err != nil && err != ErrUnresponsive {
+		return nil, err
+	}
+
+	return &Drive{
+		Id:                 entry.Id,
+		Kind:               VolumeKindDirectory,
+		Path:               entry.Path,
+		VolumeLabel:        filepath.Base(entry.Path),
+		AvailableFreeSpace: diskSpace[0],
+		TotalFreeSpace:     diskSpace[1],
+		TotalSize:          diskSpace[2],
+		BlockSize:          stats.blockSize,
+		TotalInodes:        stats.inodes,
+		FreeInodes:         stats.freeInodes,
+	}, nil
+}
+
+// applyRegistry adds the directory volumes and then the pools to the discovered drives, and applies aliases,
+// display order and hiding to all of them. Hidden drives are left out of the result but stay in their pools.
+func applyRegistry(drives []*Drive, entries map[string]VolumeEntry) []*Drive {
+	for _, entry := range entries {
+		if entry.Kind != VolumeKindDirectory {
+			continue
+		}
+		drive, err := createDirectoryDrive(entry)
+		if err != nil {
+			continue
+		}
+		drives = append(drives, drive)
+	}
+
+	byId := make(map[string]*Drive, len(drives))
+	for _, drive := range drives {
+		byId[drive.Id] = drive
+	}
+	for _, entry := range entries {
+		if entry.Kind != VolumeKindPool {
+			continue
+		}
+		drive, err := createPoolDrive(entry, byId)
+		if err != nil {
+			continue
+		}
+		drives = append(drives, drive)
+	}
+
+	visible := drives[:0]
+	for _, drive := range drives {
+		entry, ok := entries[drive.Id]
+		if ok && entry.Hidden {
+			continue
+		}
+		if ok && entry.Alias != "" {
+			drive.VolumeLabel = entry.Alias
+		}
+		drive.DisplayOrder = entry.DisplayOrder
+		visible = append(visible, drive)
+	}
+	return visible
+}
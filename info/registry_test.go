@@ -0,0 +1,37 @@
+package info
+
+import "testing"
+
+func TestValidatePoolMembers(t *testing.T) {
+	lock.RLock()
+	saved := registry
+	lock.RUnlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		registry = saved
+		lock.Unlock()
+	})
+	lock.Lock()
+	registry = map[string]VolumeEntry{
+		"photos": {Id: "photos", Kind: VolumeKindPool, Members: []string{"usb1", "usb2"}},
+		"usb1":   {Id: "usb1", Kind: VolumeKindDrive},
+	}
+	lock.Unlock()
+
+	tests := []struct {
+		name  string
+		entry VolumeEntry
+		ok    bool
+	}{
+		{"drives", VolumeEntry{Id: "media", Kind: VolumeKindPool, Members: []string{"usb1", "usb3"}}, true},
+		{"pool member", VolumeEntry{Id: "media", Kind: VolumeKindPool, Members: []string{"usb1", "photos"}}, false},
+		{"member of a pool", VolumeEntry{Id: "usb2", Kind: VolumeKindPool, Members: []string{"usb3"}}, false},
+		// Updating a pool doesn't trip over its own entry
+		{"update", VolumeEntry{Id: "photos", Kind: VolumeKindPool, Members: []string{"usb1"}}, true},
+	}
+	for _, test := range tests {
+		if err := test.entry.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
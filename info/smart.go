@@ -0,0 +1,460 @@
+package info
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	HealthPassed  = "passed"
+	HealthFailed  = "failed"
+	HealthUnknown = "unknown"
+)
+
+// smartMaxTemperature is the temperature in °C from which a disk is reported as running hot
+const smartMaxTemperature = 55
+
+// smartMaxPercentageUsed is how much of its rated endurance an SSD may use up before it is reported
+const smartMaxPercentageUsed = 90
+
+// keptSelfTests is how many of the latest self-tests are reported
+const keptSelfTests = 5
+
+// DiskHealth is the SMART health of the disk holding a drive, reported in /info.
+// Attributes the disk doesn't report are left out.
+type DiskHealth struct {
+	// Status is the overall self-assessment of the disk, unknown if smartctl couldn't read it
+	Status               string  `json:"status"`
+	Temperature          *int    `json:"temperature,omitempty"`
+	PowerOnHours         *uint64 `json:"power_on_hours,omitempty"`
+	ReallocatedSectors   *uint64 `json:"reallocated_sectors,omitempty"`
+	PendingSectors       *uint64 `json:"pending_sectors,omitempty"`
+	UncorrectableSectors *uint64 `json:"uncorrectable_sectors,omitempty"`
+	MediaErrors          *uint64 `json:"media_errors,omitempty"`
+	PercentageUsed       *int    `json:"percentage_used,omitempty"`
+	// CriticalWarning is the bit field NVMe disks set when they are about to fail
+	CriticalWarning *int       `json:"critical_warning,omitempty"`
+	SelfTests       []SelfTest `json:"self_tests"`
+	// Warnings describe what looks wrong, any of them is reason to replace the disk soon
+	Warnings  []string  `json:"warnings"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+
+	// warningKinds says what the warnings are about, to tell a new problem from a changed value
+	warningKinds []string
+}
+
+// SelfTest is an entry of the disk's self-test log, newest first.
+type SelfTest struct {
+	Type          string `json:"type"`
+	Status        string `json:"status"`
+	Passed        bool   `json:"passed"`
+	LifetimeHours uint64 `json:"lifetime_hours"`
+}
+
+// SmartRunner runs smartctl for a disk and returns its JSON output. Tests replace it to return recorded fixtures.
+type SmartRunner func(ctx context.Context, device string) ([]byte, error)
+
+type SmartConfig struct {
+	// Command is run for every disk, {device} in its arguments is replaced by the disk's device
+	Command []string
+	// Interval is how often the disks are checked, 0 disables SMART
+	Interval time.Duration
+}
+
+var smartConfig = SmartConfig{Interval: time.Hour}
+var smartRunner SmartRunner = runSmartctl
+
+// healthStates holds the latest SMART health by drive Id. It is guarded by lock, like driveMap.
+var healthStates = map[string]*DiskHealth{}
+
+// SetSmartConfig replaces the SMART command and interval. It takes effect with the next check.
+func SetSmartConfig(config SmartConfig) {
+	lock.Lock()
+	smartConfig = config
+	lock.Unlock()
+}
+
+// SetSmartRunner replaces how smartctl is run.
+func SetSmartRunner(runner SmartRunner) {
+	lock.Lock()
+	smartRunner = runner
+	lock.Unlock()
+}
+
+// SmartConfigFromEnv reads SMART_COMMAND, split on spaces and defaulting to smartctl --json --all --nocheck=standby {device},
+// and SMART_INTERVAL, defaulting to an hour. Disks in standby aren't woken up.
+func SmartConfigFromEnv() SmartConfig {
+	config := SmartConfig{
+		Command:  []string{"smartctl", "--json", "--all", "--nocheck=standby", "{device}"},
+		Interval: time.Hour,
+	}
+	if value, ok := os.LookupEnv("SMART_COMMAND"); ok {
+		config.Command = strings.Fields(value)
+	}
+	if value := os.Getenv("SMART_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			log.Printf("Invalid SMART_INTERVAL %q, using %s", value, config.Interval)
+		} else {
+			config.Interval = d
+		}
+	}
+	return config
+}
+
+// runSmartctl runs the configured command. smartctl sets bits of its exit status for failing disks too,
+// so the output is used whenever there is some and only the bits for failed commands count as errors.
+func runSmartctl(ctx context.Context, device string) ([]byte, error) {
+	lock.RLock()
+	command := smartConfig.Command
+	lock.RUnlock()
+	if len(command) == 0 {
+		return nil, errors.New("no SMART command configured")
+	}
+
+	args := make([]string, len(command)-1)
+	for i, arg := range command[1:] {
+		args[i] = strings.ReplaceAll(arg, "{device}", device)
+	}
+	output, err := exec.CommandContext(ctx, command[0], args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode()&0x3 == 0 && len(output) > 0 {
+		return output, nil
+	}
+	return output, err
+}
+
+// smartctlOutput holds the parts of smartctl's JSON output that are reported, for ATA and NVMe disks.
+type smartctlOutput struct {
+	Smartctl struct {
+		Messages []struct {
+			String string `json:"string"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current int `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime *struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	AtaSmartAttributes struct {
+		Table []struct {
+			Id  int `json:"id"`
+			Raw struct {
+				Value uint64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	AtaSmartSelfTestLog struct {
+		Standard struct {
+			Table []struct {
+				Type struct {
+					String string `json:"string"`
+				} `json:"type"`
+				Status struct {
+					String string `json:"string"`
+					Passed *bool  `json:"passed"`
+				} `json:"status"`
+				LifetimeHours uint64 `json:"lifetime_hours"`
+			} `json:"table"`
+		} `json:"standard"`
+	} `json:"ata_smart_self_test_log"`
+	NvmeSmartHealthInformationLog *struct {
+		CriticalWarning int    `json:"critical_warning"`
+		MediaErrors     uint64 `json:"media_errors"`
+		PercentageUsed  int    `json:"percentage_used"`
+	} `json:"nvme_smart_health_information_log"`
+	NvmeSelfTestLog struct {
+		Table []struct {
+			SelfTestCode struct {
+				String string `json:"string"`
+			} `json:"self_test_code"`
+			SelfTestResult struct {
+				Value  int    `json:"value"`
+				String string `json:"string"`
+			} `json:"self_test_result"`
+			PowerOnHours uint64 `json:"power_on_hours"`
+		} `json:"table"`
+	} `json:"nvme_self_test_log"`
+}
+
+// ATA attribute ids of the sector counts that predict failures best
+const (
+	attributeReallocated   = 5
+	attributePending       = 197
+	attributeUncorrectable = 198
+)
+
+// ParseSmartctl reads the JSON output of smartctl --json --all.
+func ParseSmartctl(data []byte) (*DiskHealth, error) {
+	var output smartctlOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, err
+	}
+
+	health := &DiskHealth{Status: HealthUnknown, SelfTests: []SelfTest{}, Warnings: []string{}}
+	if output.SmartStatus != nil {
+		health.Status = HealthFailed
+		if output.SmartStatus.Passed {
+			health.Status = HealthPassed
+		}
+	} else if len(output.Smartctl.Messages) > 0 {
+		health.Error = output.Smartctl.Messages[0].String
+	}
+	if output.Temperature != nil {
+		health.Temperature = &output.Temperature.Current
+	}
+	if output.PowerOnTime != nil {
+		health.PowerOnHours = &output.PowerOnTime.Hours
+	}
+
+	for _, attribute := range output.AtaSmartAttributes.Table {
+		value := attribute.Raw.Value
+		switch attribute.Id {
+		case attributeReallocated:
+			health.ReallocatedSectors = &value
+		case attributePending:
+			health.PendingSectors = &value
+		case attributeUncorrectable:
+			health.UncorrectableSectors = &value
+		}
+	}
+	for _, test := range output.AtaSmartSelfTestLog.Standard.Table {
+		health.SelfTests = append(health.SelfTests, SelfTest{
+			Type:          test.Type.String,
+			Status:        test.Status.String,
+			Passed:        test.Status.Passed == nil || *test.Status.Passed,
+			LifetimeHours: test.LifetimeHours,
+		})
+	}
+
+	if nvme := output.NvmeSmartHealthInformationLog; nvme != nil {
+		health.CriticalWarning = &nvme.CriticalWarning
+		health.MediaErrors = &nvme.MediaErrors
+		health.PercentageUsed = &nvme.PercentageUsed
+	}
+	for _, test := range output.NvmeSelfTestLog.Table {
+		// Results 0 to 2 are completed, aborted by a command or by a reset, the others are failures
+		health.SelfTests = append(health.SelfTests, SelfTest{
+			Type:          test.SelfTestCode.String,
+			Status:        test.SelfTestResult.String,
+			Passed:        test.SelfTestResult.Value <= 2,
+			LifetimeHours: test.PowerOnHours,
+		})
+	}
+	if len(health.SelfTests) > keptSelfTests {
+		health.SelfTests = health.SelfTests[:keptSelfTests]
+	}
+
+	return health, nil
+}
+
+// addWarnings fills in the warnings of a reading, replacing any it had.
+func (h *DiskHealth) addWarnings() {
+	h.Warnings = []string{}
+	h.warningKinds = nil
+	warn := func(kind string, warning string) {
+		h.Warnings = append(h.Warnings, warning)
+		h.warningKinds = append(h.warningKinds, kind)
+	}
+
+	if h.Status == HealthFailed {
+		warn("status", "SMART overall health self-assessment failed")
+	}
+	for kind, count := range h.sectorCounts() {
+		if *count > 0 {
+			warn(kind, fmt.Sprintf("%d %s", *count, kind))
+		}
+	}
+	if h.CriticalWarning != nil && *h.CriticalWarning != 0 {
+		warn("critical", fmt.Sprintf("critical warning 0x%02x", *h.CriticalWarning))
+	}
+	if h.Temperature != nil && *h.Temperature >= smartMaxTemperature {
+		warn("temperature", fmt.Sprintf("temperature of %d°C", *h.Temperature))
+	}
+	if h.PercentageUsed != nil && *h.PercentageUsed >= smartMaxPercentageUsed {
+		warn("endurance", fmt.Sprintf("%d%% of the rated endurance used", *h.PercentageUsed))
+	}
+	if len(h.SelfTests) > 0 && !h.SelfTests[0].Passed {
+		warn("self-test", "last self-test failed: "+h.SelfTests[0].Status)
+	}
+	sort.Strings(h.Warnings)
+	sort.Strings(h.warningKinds)
+}
+
+// sectorCounts returns the error counts the disk reports by what they count.
+func (h *DiskHealth) sectorCounts() map[string]*uint64 {
+	counts := map[string]*uint64{}
+	for kind, count := range map[string]*uint64{
+		"reallocated sectors":   h.ReallocatedSectors,
+		"pending sectors":       h.PendingSectors,
+		"uncorrectable sectors": h.UncorrectableSectors,
+		"media errors":          h.MediaErrors,
+	} {
+		if count != nil {
+			counts[kind] = count
+		}
+	}
+	return counts
+}
+
+// degradedSince reports whether the disk got worse than in the previous reading: a new kind of warning
+// or a growing error count. Changes within a warning, like the temperature, don't count.
+func (h *DiskHealth) degradedSince(previous *DiskHealth) bool {
+	if previous == nil {
+		return len(h.warningKinds) > 0
+	}
+	for _, kind := range h.warningKinds {
+		if !containsString(previous.warningKinds, kind) {
+			return true
+		}
+	}
+	before := previous.sectorCounts()
+	for kind, count := range h.sectorCounts() {
+		if b, ok := before[kind]; ok && *count > *b {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHealth reads the SMART health of every drive and notifies the sinks when a drive's warnings change.
+// Drives on the same disk share one reading.
+func checkHealth(ctx context.Context) {
+	lock.RLock()
+	runner := smartRunner
+	lock.RUnlock()
+
+	readings := map[string]*DiskHealth{}
+	for _, drive := range Drives() {
+		if drive.Kind != VolumeKindDrive || drive.CheckAvailable() != nil {
+			continue
+		}
+		device := smartDevice(drive)
+		if device == "" {
+			continue
+		}
+
+		health, ok := readings[device]
+		if !ok {
+			health = readHealth(ctx, runner, device)
+			readings[device] = health
+		}
+		if health == nil {
+			continue
+		}
+
+		current := *health
+		current.addWarnings()
+		lock.Lock()
+		previous := healthStates[drive.Id]
+		healthStates[drive.Id] = &current
+		updateDrive(drive.Id, applyHealth)
+		sinks := alertConfig.Sinks
+		lock.Unlock()
+
+		// Alerts fire when the disk degrades and resolve once it has no warnings left
+		degraded := current.degradedSince(previous)
+		resolved := previous != nil && len(previous.warningKinds) > 0 && len(current.warningKinds) == 0
+		if !degraded && !resolved {
+			continue
+		}
+
+		alert := Alert{
+			Type:        AlertDiskHealth,
+			Volume:      drive.Id,
+			VolumeLabel: drive.VolumeLabel,
+			Path:        drive.Path,
+			Firing:      degraded,
+			Warnings:    current.Warnings,
+			TotalSize:   drive.TotalSize,
+			Time:        current.CheckedAt,
+		}
+		for _, sink := range sinks {
+			go func(sink AlertSink) {
+				if err := sink.Notify(alert); err != nil {
+					log.Printf("Error sending alert for %s: %v", alert.Volume, err)
+				}
+			}(sink)
+		}
+	}
+}
+
+// smartTimeout bounds a single smartctl run, USB bridges can hang on commands they don't understand
+const smartTimeout = 30 * time.Second
+
+// readHealth runs smartctl for the device. Failures are kept as a reading with the error, so /info shows why
+// there is no health, but a disk in standby keeps its last reading.
+func readHealth(ctx context.Context, runner SmartRunner, device string) *DiskHealth {
+	ctx, cancel := context.WithTimeout(ctx, smartTimeout)
+	defer cancel()
+
+	output, err := runner(ctx, device)
+	now := time.Now().UTC()
+	if len(bytes.TrimSpace(output)) == 0 {
+		if err == nil {
+			err = errors.New("smartctl printed nothing")
+		}
+		return &DiskHealth{Status: HealthUnknown, SelfTests: []SelfTest{}, Warnings: []string{}, Error: err.Error(), CheckedAt: now}
+	}
+
+	health, parseErr := ParseSmartctl(output)
+	if parseErr != nil {
+		return &DiskHealth{Status: HealthUnknown, SelfTests: []SelfTest{}, Warnings: []string{}, Error: parseErr.Error(), CheckedAt: now}
+	}
+	if health.Status == HealthUnknown && strings.Contains(strings.ToUpper(health.Error), "STANDBY") {
+		return nil
+	}
+	if health.Error == "" && err != nil {
+		health.Error = err.Error()
+	}
+	health.CheckedAt = now
+	return health
+}
+
+// watchHealth checks the SMART health on the configured interval until ctx is done.
+func watchHealth(ctx context.Context) {
+	for {
+		lock.RLock()
+		interval := smartConfig.Interval
+		lock.RUnlock()
+		if interval == 0 {
+			return
+		}
+
+		checkHealth(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping SMART checks...")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// applyHealth sets the drive's SMART health. It must be called with lock held.
+func applyHealth(drive *Drive) {
+	drive.Health = healthStates[drive.Id]
+}
@@ -0,0 +1,202 @@
+package info
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func readSmartFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "smart", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseSmartctlWarnings(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		status   string
+		warnings []string
+	}{
+		{"passed", HealthPassed, []string{}},
+		{"failed", HealthFailed, []string{
+			"16 pending sectors",
+			"16 uncorrectable sectors",
+			"4008 reallocated sectors",
+			"SMART overall health self-assessment failed",
+			"last self-test failed: Completed: read failure",
+		}},
+		{"sectors", HealthPassed, []string{
+			"2 pending sectors",
+			"8 reallocated sectors",
+			"temperature of 57°C",
+		}},
+		{"nvme", HealthPassed, []string{
+			"3 media errors",
+			"93% of the rated endurance used",
+		}},
+		{"nosmart", HealthUnknown, []string{}},
+	}
+	for _, test := range tests {
+		health, err := ParseSmartctl(readSmartFixture(t, test.fixture))
+		if err != nil {
+			t.Errorf("%s: %v", test.fixture, err)
+			continue
+		}
+		health.addWarnings()
+		if health.Status != test.status {
+			t.Errorf("%s: status %q, want %q", test.fixture, health.Status, test.status)
+		}
+		if !reflect.DeepEqual(health.Warnings, test.warnings) {
+			t.Errorf("%s: warnings %q, want %q", test.fixture, health.Warnings, test.warnings)
+		}
+	}
+}
+
+func TestParseSmartctlAttributes(t *testing.T) {
+	health, err := ParseSmartctl(readSmartFixture(t, "passed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Temperature == nil || *health.Temperature != 34 {
+		t.Errorf("temperature %v, want 34", health.Temperature)
+	}
+	if health.PowerOnHours == nil || *health.PowerOnHours != 12345 {
+		t.Errorf("power-on hours %v, want 12345", health.PowerOnHours)
+	}
+	if health.ReallocatedSectors == nil || *health.ReallocatedSectors != 0 {
+		t.Errorf("reallocated sectors %v, want 0", health.ReallocatedSectors)
+	}
+	// ATA disks have no NVMe log
+	if health.MediaErrors != nil || health.PercentageUsed != nil {
+		t.Errorf("NVMe attributes reported for an ATA disk")
+	}
+	want := []SelfTest{
+		{Type: "Short offline", Status: "Completed without error", Passed: true, LifetimeHours: 12301},
+		{Type: "Extended offline", Status: "Completed without error", Passed: true, LifetimeHours: 11020},
+	}
+	if !reflect.DeepEqual(health.SelfTests, want) {
+		t.Errorf("self-tests %+v, want %+v", health.SelfTests, want)
+	}
+}
+
+// TestReadHealthExitStatus runs the fixtures through runSmartctl with the exit status smartctl had,
+// since which bits are set decides whether the output is used.
+func TestReadHealthExitStatus(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh to replay smartctl")
+	}
+	lock.RLock()
+	saved := smartConfig
+	lock.RUnlock()
+	defer SetSmartConfig(saved)
+
+	tests := []struct {
+		fixture    string
+		exitStatus int
+		// standby means no reading, the previous one is kept
+		standby  bool
+		status   string
+		hasError bool
+	}{
+		{fixture: "passed", exitStatus: 0, status: HealthPassed},
+		// Failing disk, prefail attributes, errors in the error and self-test logs
+		{fixture: "failed", exitStatus: 8 | 64 | 128, status: HealthFailed},
+		{fixture: "sectors", exitStatus: 64, status: HealthPassed},
+		{fixture: "standby", exitStatus: 2, standby: true},
+		// Command line or device open failed, the messages say why
+		{fixture: "nosmart", exitStatus: 1, status: HealthUnknown, hasError: true},
+	}
+	for _, test := range tests {
+		SetSmartConfig(SmartConfig{
+			Command:  []string{"sh", "-c", "cat testdata/smart/{device}.json; exit " + strconv.Itoa(test.exitStatus)},
+			Interval: saved.Interval,
+		})
+
+		health := readHealth(context.Background(), runSmartctl, test.fixture)
+		if test.standby {
+			if health != nil {
+				t.Errorf("%s: got a reading for a disk in standby: %+v", test.fixture, health)
+			}
+			continue
+		}
+		if health == nil {
+			t.Errorf("%s: no reading", test.fixture)
+			continue
+		}
+		if health.Status != test.status {
+			t.Errorf("%s: status %q, want %q", test.fixture, health.Status, test.status)
+		}
+		if (health.Error != "") != test.hasError {
+			t.Errorf("%s: error %q", test.fixture, health.Error)
+		}
+		if health.CheckedAt.IsZero() {
+			t.Errorf("%s: reading has no time", test.fixture)
+		}
+	}
+}
+
+func TestReadHealthRunner(t *testing.T) {
+	var devices []string
+	runner := func(ctx context.Context, device string) ([]byte, error) {
+		devices = append(devices, device)
+		return readSmartFixture(t, "failed"), nil
+	}
+
+	health := readHealth(context.Background(), runner, "/dev/sdb")
+	if !reflect.DeepEqual(devices, []string{"/dev/sdb"}) {
+		t.Errorf("runner called for %q", devices)
+	}
+	if health == nil || health.Status != HealthFailed || health.Error != "" {
+		t.Errorf("got %+v", health)
+	}
+
+	empty := readHealth(context.Background(), func(context.Context, string) ([]byte, error) { return nil, nil }, "/dev/sdb")
+	if empty == nil || empty.Status != HealthUnknown || empty.Error == "" {
+		t.Errorf("empty output gave %+v", empty)
+	}
+}
+
+func TestDegradedSince(t *testing.T) {
+	read := func(fixture string) *DiskHealth {
+		health, err := ParseSmartctl(readSmartFixture(t, fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		health.addWarnings()
+		return health
+	}
+	passed := read("passed")
+	sectors := read("sectors")
+
+	if passed.degradedSince(nil) {
+		t.Error("a healthy first reading degraded")
+	}
+	if !sectors.degradedSince(nil) || !sectors.degradedSince(passed) {
+		t.Error("new sector counts didn't degrade")
+	}
+	if sectors.degradedSince(sectors) {
+		t.Error("the same reading degraded")
+	}
+
+	// Another temperature is no news, another reallocated sector is
+	warmer := read("sectors")
+	*warmer.Temperature = 60
+	warmer.addWarnings()
+	if warmer.degradedSince(sectors) {
+		t.Error("a temperature change degraded")
+	}
+	worse := read("sectors")
+	*worse.ReallocatedSectors = 9
+	worse.addWarnings()
+	if !worse.degradedSince(sectors) {
+		t.Error("a growing sector count didn't degrade")
+	}
+}
@@ -0,0 +1,171 @@
+package info
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type SystemStats struct {
+	Time time.Time `json:"time"`
+	// CpuTemperature is in degrees Celsius, nil if there is no thermal sensor
+	CpuTemperature *float64          `json:"cpu_temperature"`
+	Throttling     *Throttling       `json:"throttling"`
+	LoadAverage    [3]float64        `json:"load_average"`
+	Memory         MemoryStats       `json:"memory"`
+	Uptime         float64           `json:"uptime"`
+	Network        []*InterfaceStats `json:"network"`
+	Process        ProcessStats      `json:"process"`
+}
+
+// Throttling decodes the Raspberry Pi firmware's get_throttled bits.
+type Throttling struct {
+	Raw                   uint32 `json:"raw"`
+	UnderVoltage          bool   `json:"under_voltage"`
+	FrequencyCapped       bool   `json:"frequency_capped"`
+	Throttled             bool   `json:"throttled"`
+	SoftTemperatureLimit  bool   `json:"soft_temperature_limit"`
+	UnderVoltageOccurred  bool   `json:"under_voltage_occurred"`
+	FrequencyCapOccurred  bool   `json:"frequency_cap_occurred"`
+	ThrottlingOccurred    bool   `json:"throttling_occurred"`
+	SoftTempLimitOccurred bool   `json:"soft_temperature_limit_occurred"`
+}
+
+// MemoryStats are in bytes.
+type MemoryStats struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+	Free      uint64 `json:"free"`
+	SwapTotal uint64 `json:"swap_total"`
+	SwapFree  uint64 `json:"swap_free"`
+}
+
+type InterfaceStats struct {
+	Name    string `json:"name"`
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+	// Throughput since the previous sample, in bytes per second
+	RxRate float64 `json:"rx_rate"`
+	TxRate float64 `json:"tx_rate"`
+}
+
+type ProcessStats struct {
+	Goroutines int    `json:"goroutines"`
+	Rss        uint64 `json:"rss"`
+	OpenFds    int    `json:"open_fds"`
+}
+
+const (
+	systemSampleInterval = 10 * time.Second
+	// systemHistorySize keeps one hour of samples
+	systemHistorySize = 360
+)
+
+// systemRoot is prepended to every /proc and /sys path. Tests point it at fixture trees.
+var systemRoot = "/"
+
+var systemHistory []*SystemStats
+var systemLock = sync.RWMutex{}
+
+func newThrottling(raw uint32) *Throttling {
+	return &Throttling{
+		Raw:                   raw,
+		UnderVoltage:          raw&(1<<0) != 0,
+		FrequencyCapped:       raw&(1<<1) != 0,
+		Throttled:             raw&(1<<2) != 0,
+		SoftTemperatureLimit:  raw&(1<<3) != 0,
+		UnderVoltageOccurred:  raw&(1<<16) != 0,
+		FrequencyCapOccurred:  raw&(1<<17) != 0,
+		ThrottlingOccurred:    raw&(1<<18) != 0,
+		SoftTempLimitOccurred: raw&(1<<19) != 0,
+	}
+}
+
+// sampleSystem reads the system stats and derives network throughput from the previous sample.
+func sampleSystem() *SystemStats {
+	stats := readSystemStats(systemRoot)
+	stats.Time = time.Now().UTC()
+	stats.Process.Goroutines = runtime.NumGoroutine()
+
+	systemLock.RLock()
+	var prev *SystemStats
+	if len(systemHistory) > 0 {
+		prev = systemHistory[len(systemHistory)-1]
+	}
+	systemLock.RUnlock()
+
+	if prev != nil {
+		if elapsed := stats.Time.Sub(prev.Time).Seconds(); elapsed > 0 {
+			for _, iface := range stats.Network {
+				for _, old := range prev.Network {
+					if old.Name == iface.Name && iface.RxBytes >= old.RxBytes && iface.TxBytes >= old.TxBytes {
+						iface.RxRate = float64(iface.RxBytes-old.RxBytes) / elapsed
+						iface.TxRate = float64(iface.TxBytes-old.TxBytes) / elapsed
+					}
+				}
+			}
+		}
+	}
+
+	return stats
+}
+
+// recordSystemStats samples the system periodically into a fixed size history until ctx is done.
+func recordSystemStats(ctx context.Context) {
+	ticker := time.NewTicker(systemSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		stats := sampleSystem()
+
+		systemLock.Lock()
+		systemHistory = append(systemHistory, stats)
+		if len(systemHistory) > systemHistorySize {
+			systemHistory = systemHistory[len(systemHistory)-systemHistorySize:]
+		}
+		systemLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping system sampling...")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getSystem corresponds to the GET /info/system endpoint.
+// With history=true the recorded samples of the last hour are included, oldest first.
+func getSystem(w http.ResponseWriter, r *http.Request) {
+	var history bool
+	if historyValue := r.FormValue("history"); historyValue != "" {
+		var err error
+		history, err = strconv.ParseBool(historyValue)
+		if err != nil {
+			log.Printf("History query param error, %v", err)
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	response := struct {
+		Current *SystemStats   `json:"current"`
+		History []*SystemStats `json:"history,omitempty"`
+	}{
+		Current: sampleSystem(),
+	}
+
+	if history {
+		systemLock.RLock()
+		response.History = append([]*SystemStats{}, systemHistory...)
+		systemLock.RUnlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,133 @@
+// +build linux
+
+package info
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readSystemStats reads everything but the goroutine count from /proc and /sys below root.
+// Missing files leave their values empty, not every board has every sensor.
+func readSystemStats(root string) *SystemStats {
+	stats := &SystemStats{}
+
+	if milli, err := readInt(filepath.Join(root, "sys/class/thermal/thermal_zone0/temp")); err == nil {
+		temperature := float64(milli) / 1000
+		stats.CpuTemperature = &temperature
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(root, "sys/devices/platform/soc/soc:firmware/get_throttled")); err == nil {
+		if raw, err := strconv.ParseUint(strings.TrimSpace(string(data)), 16, 32); err == nil {
+			stats.Throttling = newThrottling(uint32(raw))
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(root, "proc/loadavg")); err == nil {
+		fields := strings.Fields(string(data))
+		for i := 0; i < 3 && i < len(fields); i++ {
+			stats.LoadAverage[i], _ = strconv.ParseFloat(fields[i], 64)
+		}
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(root, "proc/uptime")); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			stats.Uptime, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	meminfo := readKeyValues(filepath.Join(root, "proc/meminfo"))
+	stats.Memory = MemoryStats{
+		Total:     meminfo["MemTotal"],
+		Available: meminfo["MemAvailable"],
+		Free:      meminfo["MemFree"],
+		SwapTotal: meminfo["SwapTotal"],
+		SwapFree:  meminfo["SwapFree"],
+	}
+
+	stats.Network = readNetDev(filepath.Join(root, "proc/net/dev"))
+
+	stats.Process.Rss = readKeyValues(filepath.Join(root, "proc/self/status"))["VmRSS"]
+	if fds, err := ioutil.ReadDir(filepath.Join(root, "proc/self/fd")); err == nil {
+		stats.Process.OpenFds = len(fds)
+	}
+
+	return stats
+}
+
+func readInt(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readKeyValues parses "Key:   value kB" lines like in /proc/meminfo. Values in kB are converted to bytes.
+func readKeyValues(path string) map[string]uint64 {
+	values := map[string]uint64{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		keyValue := strings.SplitN(scanner.Text(), ":", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		fields := strings.Fields(keyValue[1])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		values[keyValue[0]] = value
+	}
+
+	return values
+}
+
+// readNetDev parses the byte counters of every interface but loopback from /proc/net/dev.
+func readNetDev(path string) []*InterfaceStats {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var interfaces []*InterfaceStats
+	for _, line := range strings.Split(string(data), "\n") {
+		nameCounters := strings.SplitN(line, ":", 2)
+		if len(nameCounters) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(nameCounters[0])
+		counters := strings.Fields(nameCounters[1])
+		if name == "lo" || len(counters) < 9 {
+			continue
+		}
+		rx, err := strconv.ParseUint(counters[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		tx, err := strconv.ParseUint(counters[8], 10, 64)
+		if err != nil {
+			continue
+		}
+		interfaces = append(interfaces, &InterfaceStats{Name: name, RxBytes: rx, TxBytes: tx})
+	}
+
+	return interfaces
+}
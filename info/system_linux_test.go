@@ -0,0 +1,105 @@
+// +build linux
+
+package info
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadSystemStats(t *testing.T) {
+	stats := readSystemStats(filepath.Join("testdata", "system", "raspberrypi"))
+
+	if stats.CpuTemperature == nil || *stats.CpuTemperature != 48.312 {
+		t.Errorf("cpu temperature %v, want 48.312", stats.CpuTemperature)
+	}
+	if stats.LoadAverage != [3]float64{0.52, 0.58, 0.59} {
+		t.Errorf("load average %v", stats.LoadAverage)
+	}
+	if stats.Uptime != 350735.47 {
+		t.Errorf("uptime %v", stats.Uptime)
+	}
+	wantMemory := MemoryStats{
+		Total:     3885396 * 1024,
+		Available: 2718752 * 1024,
+		Free:      220500 * 1024,
+		SwapTotal: 102396 * 1024,
+		SwapFree:  102396 * 1024,
+	}
+	if stats.Memory != wantMemory {
+		t.Errorf("memory %+v, want %+v", stats.Memory, wantMemory)
+	}
+	// Loopback is left out
+	wantNetwork := []*InterfaceStats{
+		{Name: "eth0", RxBytes: 1898361245, TxBytes: 29137730291},
+		{Name: "wlan0"},
+	}
+	if !reflect.DeepEqual(stats.Network, wantNetwork) {
+		t.Errorf("network %+v, want %+v", stats.Network, wantNetwork)
+	}
+	if stats.Process.Rss != 18432*1024 || stats.Process.OpenFds != 5 {
+		t.Errorf("process %+v", stats.Process)
+	}
+}
+
+func TestReadSystemStatsMissingFiles(t *testing.T) {
+	stats := readSystemStats(t.TempDir())
+	if stats.CpuTemperature != nil || stats.Throttling != nil || stats.Network != nil {
+		t.Errorf("got %+v from an empty root", stats)
+	}
+	if stats.Memory != (MemoryStats{}) || stats.Process.OpenFds != 0 {
+		t.Errorf("got %+v from an empty root", stats)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	stats := readSystemStats(filepath.Join("testdata", "system", "raspberrypi"))
+
+	// 0x50005 is under-voltage and throttling now, both have also occurred since boot
+	want := &Throttling{
+		Raw:                  0x50005,
+		UnderVoltage:         true,
+		Throttled:            true,
+		UnderVoltageOccurred: true,
+		ThrottlingOccurred:   true,
+	}
+	if !reflect.DeepEqual(stats.Throttling, want) {
+		t.Errorf("throttling %+v, want %+v", stats.Throttling, want)
+	}
+
+	all := newThrottling(0xf000f)
+	if !all.FrequencyCapped || !all.SoftTemperatureLimit || !all.FrequencyCapOccurred || !all.SoftTempLimitOccurred {
+		t.Errorf("newThrottling(0xf000f) = %+v", all)
+	}
+}
+
+func TestSampleSystemRates(t *testing.T) {
+	savedRoot := systemRoot
+	systemRoot = filepath.Join("testdata", "system", "raspberrypi")
+	systemLock.Lock()
+	savedHistory := systemHistory
+	systemHistory = []*SystemStats{{
+		Time:    time.Now().UTC().Add(-10 * time.Second),
+		Network: []*InterfaceStats{{Name: "eth0", RxBytes: 1898361245 - 10000, TxBytes: 29137730291 - 20000}},
+	}}
+	systemLock.Unlock()
+	t.Cleanup(func() {
+		systemRoot = savedRoot
+		systemLock.Lock()
+		systemHistory = savedHistory
+		systemLock.Unlock()
+	})
+
+	stats := sampleSystem()
+	eth0 := stats.Network[0]
+	// About 1000 and 2000 bytes per second, the test may take a moment
+	if eth0.RxRate < 900 || eth0.RxRate > 1000 || eth0.TxRate < 1800 || eth0.TxRate > 2000 {
+		t.Errorf("rates %v and %v", eth0.RxRate, eth0.TxRate)
+	}
+	// No previous counters, no rate
+	if wlan0 := stats.Network[1]; wlan0.RxRate != 0 || wlan0.TxRate != 0 {
+		t.Errorf("wlan0 rates %v and %v", wlan0.RxRate, wlan0.TxRate)
+	}
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package info
+
+// readSystemStats has nothing to read on Windows, only the process' goroutines are reported.
+func readSystemStats(_ string) *SystemStats {
+	return &SystemStats{}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gorilla/mux"
+	"guptaspi/metrics"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpRequestsTotal = metrics.NewCounter(
+		"guptaspi_http_requests_total", "HTTP requests served, by route, method and status.",
+		"route", "method", "status",
+	)
+	httpRequestDuration = metrics.NewHistogram(
+		"guptaspi_http_request_duration_seconds", "Time taken to serve HTTP requests, by route and method.",
+		metrics.DefaultBuckets, "route", "method",
+	)
+	loginsTotal = metrics.NewCounter(
+		"guptaspi_logins_total", "Login attempts, by outcome.", "outcome",
+	)
+	tokenCleanupRuns = metrics.NewCounter(
+		"guptaspi_token_cleanup_runs_total", "Runs of the expired token cleanup.",
+	)
+)
+
+// defaultMetricsNetworks lets anything on the LAN scrape /metrics when no token or networks are configured.
+const defaultMetricsNetworks = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,127.0.0.0/8,::1/128,fc00::/7"
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps streaming responses like /info/events working through the recorder.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReadFrom hands copies to the underlying writer, so http.ServeContent keeps sending files with sendfile.
+func (sr *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := sr.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(sr.ResponseWriter, src)
+}
+
+// metricsMiddleware counts requests and their latencies by route template, so IDs in paths don't create new series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		httpRequestsTotal.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// metricsAuth guards /metrics with its own bearer token and/or network allowlist, as scrapers don't log in.
+type metricsAuth struct {
+	token          string
+	networks       networkList
+	trustedProxies networkList
+}
+
+func newMetricsAuth(trustedProxies networkList) *metricsAuth {
+	ma := &metricsAuth{token: os.Getenv("METRICS_TOKEN"), trustedProxies: trustedProxies}
+
+	allowed := os.Getenv("METRICS_ALLOWED_NETWORKS")
+	if allowed == "" && ma.token == "" {
+		allowed = defaultMetricsNetworks
+	}
+	networks, err := parseNetworks(allowed)
+	if err != nil {
+		log.Fatalf("Error parsing METRICS_ALLOWED_NETWORKS: %v\n", err)
+	}
+	ma.networks = networks
+
+	return ma
+}
+
+func (ma *metricsAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(ma.networks) > 0 && !ma.networks.contains(clientIP(r, ma.trustedProxies)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if ma.token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ma.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	metrics.Handler(w, r)
+}
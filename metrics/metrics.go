@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family that can write itself in the Prometheus text format.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+var collectors []collector
+var lock = sync.RWMutex{}
+
+func register(c collector) {
+	lock.Lock()
+	collectors = append(collectors, c)
+	lock.Unlock()
+}
+
+// Sample is a single value of a GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type Counter struct {
+	metricName string
+	help       string
+	labelNames []string
+	lock       sync.Mutex
+	values     map[string]float64
+}
+
+// NewCounter creates and registers a counter. Label values are passed to Inc and Add in the same order as labelNames.
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{metricName: name, help: help, labelNames: labelNames, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labelNames, labelValues)
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", c.metricName, key, formatValue(c.values[key]))
+	}
+}
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+type Histogram struct {
+	metricName string
+	help       string
+	labelNames []string
+	buckets    []float64
+	lock       sync.Mutex
+	values     map[string]*histogramValue
+}
+
+// NewHistogram creates and registers a histogram with the given upper bucket bounds.
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{metricName: name, help: help, labelNames: labelNames, buckets: buckets, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labelNames, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.metricName, h.help, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, h.labelNames...), "le")
+	for _, key := range keys {
+		value := h.values[key]
+		for i, bound := range h.buckets {
+			labels := formatLabels(bucketLabels, append(append([]string{}, value.labelValues...), formatValue(bound)))
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, labels, value.counts[i])
+		}
+		labels := formatLabels(bucketLabels, append(append([]string{}, value.labelValues...), "+Inf"))
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, labels, value.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, key, formatValue(value.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, key, value.count)
+	}
+}
+
+// GaugeFunc reads its samples when scraped, for values that are owned elsewhere.
+type GaugeFunc struct {
+	metricName string
+	help       string
+	kind       string
+	labelNames []string
+	collect    func() []Sample
+}
+
+// NewGaugeFunc creates and registers a gauge whose samples are returned by collect on every scrape.
+func NewGaugeFunc(name string, help string, labelNames []string, collect func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, kind: "gauge", labelNames: labelNames, collect: collect}
+	register(g)
+	return g
+}
+
+// NewCounterFunc is like NewGaugeFunc, for counters kept elsewhere, like the kernel's.
+func NewCounterFunc(name string, help string, labelNames []string, collect func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{metricName: name, help: help, kind: "counter", labelNames: labelNames, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, g.kind)
+	for _, sample := range g.collect() {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", g.metricName, formatLabels(g.labelNames, sample.LabelValues), formatValue(sample.Value))
+	}
+}
+
+// Handler writes every registered metric in the Prometheus text exposition format.
+func Handler(w http.ResponseWriter, _ *http.Request) {
+	lock.RLock()
+	sorted := append([]collector{}, collectors...)
+	lock.RUnlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name() < sorted[j].name()
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range sorted {
+		c.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help))
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// schemaStatements are idempotent statements that create or adjust the tables
+// the server depends on besides users, access_tokens and refresh_tokens.
+var schemaStatements = []string{
+	// argon2id hashes don't fit into the 60 characters used for bcrypt
+	"ALTER TABLE users MODIFY password VARCHAR(255) NOT NULL",
+	`CREATE TABLE IF NOT EXISTS files (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		user_id BIGINT UNSIGNED NOT NULL,
+		volume VARCHAR(255) NOT NULL,
+		path VARCHAR(4096) NOT NULL,
+		size BIGINT UNSIGNED NOT NULL,
+		created DATETIME NOT NULL,
+		INDEX (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS signing_keys (
+		key_id VARCHAR(64) NOT NULL PRIMARY KEY,
+		user_id BIGINT UNSIGNED NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		secret VARCHAR(128) NOT NULL,
+		allowed_networks VARCHAR(1024) NOT NULL DEFAULT '',
+		created DATETIME NOT NULL,
+		last_used DATETIME NULL,
+		INDEX (user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		time DATETIME NOT NULL,
+		event VARCHAR(64) NOT NULL,
+		outcome VARCHAR(16) NOT NULL,
+		user_id BIGINT UNSIGNED NULL,
+		username VARCHAR(255) NOT NULL,
+		ip VARCHAR(64) NOT NULL,
+		user_agent VARCHAR(512) NOT NULL,
+		detail VARCHAR(1024) NOT NULL,
+		INDEX (time),
+		INDEX (user_id),
+		INDEX (event)
+	)`,
+	`CREATE TABLE IF NOT EXISTS volumes (
+		id VARCHAR(64) NOT NULL PRIMARY KEY,
+		kind VARCHAR(16) NOT NULL,
+		path VARCHAR(4096) NOT NULL DEFAULT '',
+		alias VARCHAR(255) NOT NULL DEFAULT '',
+		hidden BOOLEAN NOT NULL DEFAULT FALSE,
+		display_order INT NOT NULL DEFAULT 0
+	)`,
+}
+
+// columnMigration adds a column to an existing table if it isn't there yet.
+// After is run once, directly after the column was added.
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+	After      string
+}
+
+var columnMigrations = []columnMigration{
+	{Table: "users", Column: "role", Definition: "VARCHAR(32) NOT NULL DEFAULT 'user'",
+		// The oldest account becomes the first admin, so there is always someone able to manage users
+		After: "UPDATE users SET role = 'admin' ORDER BY id LIMIT 1"},
+	{Table: "users", Column: "disabled", Definition: "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{Table: "users", Column: "last_login", Definition: "DATETIME NULL"},
+	{Table: "users", Column: "allowed_networks", Definition: "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{Table: "access_tokens", Column: "allowed_networks", Definition: "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{Table: "refresh_tokens", Column: "allowed_networks", Definition: "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{Table: "volumes", Column: "members", Definition: "VARCHAR(1024) NOT NULL DEFAULT ''"},
+	{Table: "volumes", Column: "policy", Definition: "VARCHAR(32) NOT NULL DEFAULT ''"},
+}
+
+// migrate brings the database schema up to date. It is safe to run on every start.
+func migrate(db *sql.DB) error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range columnMigrations {
+		exists, err := columnExists(db, m.Table, m.Column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		log.Printf("Adding column %s.%s", m.Table, m.Column)
+		if _, err := db.Exec("ALTER TABLE " + m.Table + " ADD COLUMN " + m.Column + " " + m.Definition); err != nil {
+			return err
+		}
+		if m.After != "" {
+			if _, err := db.Exec(m.After); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func columnExists(db *sql.DB, table string, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table, column,
+	).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
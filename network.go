@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// networkList is a CIDR allowlist. An empty list allows every address.
+type networkList []*net.IPNet
+
+// parseNetworks parses a comma separated list of CIDRs. Plain IP addresses are treated as single hosts.
+func parseNetworks(s string) (networkList, error) {
+	var networks networkList
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", part)
+			}
+			if ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", part)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (n networkList) String() string {
+	parts := make([]string, len(n))
+	for i, network := range n {
+		parts[i] = network.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// allows reports whether ip is inside one of the networks, or true if the list is empty.
+func (n networkList) allows(ip net.IP) bool {
+	if len(n) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains is like allows, except an empty list contains nothing.
+func (n networkList) contains(ip net.IP) bool {
+	return len(n) > 0 && n.allows(ip)
+}
+
+// networksAllow parses each stored allowlist and reports whether ip passes all of them.
+// A list that can't be parsed rejects everything.
+func networksAllow(ip net.IP, lists ...string) bool {
+	for _, list := range lists {
+		networks, err := parseNetworks(list)
+		if err != nil || !networks.allows(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientIP returns the address of the client that made the request.
+// X-Forwarded-For is only followed through the trusted reverse proxies, from the closest hop backwards,
+// so a client can't spoof its address by sending the header itself.
+func clientIP(r *http.Request, trustedProxies networkList) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	if !trustedProxies.contains(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Can't trust anything further back than a malformed entry
+			return ip
+		}
+		ip = hop
+		if !trustedProxies.contains(hop) {
+			return hop
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// argon2Default is tuned so a login takes roughly a quarter of a second on a Raspberry Pi 4
+// without starving the other requests of memory.
+var argon2Default = argon2Params{
+	Memory:      32 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// hashPassword hashes the password with argon2id and encodes it in the PHC string format.
+func hashPassword(password string) (string, error) {
+	p := argon2Default
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword checks the password against a stored argon2id or bcrypt hash.
+// The second return value is true if the hash should be replaced by one from hashPassword.
+func verifyPassword(hash string, password string) (bool, bool, error) {
+	if strings.HasPrefix(hash, "$2") {
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			if err == bcrypt.ErrMismatchedHashAndPassword {
+				return false, false, nil
+			}
+			return false, false, err
+		}
+		return true, true, nil
+	}
+
+	p, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return false, false, nil
+	}
+
+	return true, p != argon2Default, nil
+}
+
+func decodeArgon2Hash(hash string) (p argon2Params, salt []byte, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errInvalidHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, errInvalidHash
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	p.SaltLength = uint32(len(salt))
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+type passwordPolicy struct {
+	MinLength int
+	MaxLength int
+	// BreachedList is an optional file of SHA-1 password hashes, one per line and sorted by hash,
+	// in the format of the offline Have I Been Pwned downloads (HASH or HASH:COUNT).
+	BreachedList string
+}
+
+// loadPasswordPolicy reads the policy from the PASSWORD_MIN_LENGTH and PASSWORD_BREACHED_LIST environment variables.
+func loadPasswordPolicy() passwordPolicy {
+	policy := passwordPolicy{
+		MinLength:    10,
+		MaxLength:    256,
+		BreachedList: os.Getenv("PASSWORD_BREACHED_LIST"),
+	}
+
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		if n, err := strconv.Atoi(minLength); err != nil || n < 1 {
+			log.Printf("Invalid PASSWORD_MIN_LENGTH %q, using %d", minLength, policy.MinLength)
+		} else {
+			policy.MinLength = n
+		}
+	}
+
+	return policy
+}
+
+// check returns an error describing why the password is not allowed, or nil if it is.
+func (p passwordPolicy) check(username string, password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if length > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+
+	lower := strings.ToLower(password)
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+	if _, ok := commonPasswords[lower]; ok {
+		return errors.New("password is too common")
+	}
+
+	if p.BreachedList != "" {
+		breached, err := inBreachedList(p.BreachedList, password)
+		if err != nil {
+			// The list is an extra safeguard, don't lock users out when it's missing
+			log.Printf("Error reading breached password list: %v", err)
+		} else if breached {
+			return errors.New("password appears in a known data breach")
+		}
+	}
+
+	return nil
+}
+
+// inBreachedList looks the password's SHA-1 up in the breached list with a binary search, so the list, which has
+// hundreds of millions of lines, is neither read whole nor kept in memory. The list must be sorted by hash, like
+// the Have I Been Pwned downloads ordered by hash are.
+func inBreachedList(path string, password string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	h := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(h[:]))
+
+	// lo is always the start of a line, every line before it has a smaller hash
+	lo, hi := int64(0), stat.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		hash, start, end, err := breachedLineFrom(f, mid, stat.Size())
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case start >= hi:
+			// No line starts between mid and hi
+			hi = mid
+		case hash == target:
+			return true, nil
+		case hash < target:
+			lo = end
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// breachedLineFrom reads the first line of the list that starts at or after offset. It returns the line's hash,
+// uppercased and without the count, and where the line starts and ends, past its newline.
+func breachedLineFrom(f io.ReaderAt, offset int64, size int64) (string, int64, int64, error) {
+	start := offset
+	if offset > 0 {
+		// Unless offset is right after a newline it is in the middle of a line, which is skipped
+		start = offset - 1
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	if offset > 0 {
+		skipped, err := r.ReadString('\n')
+		start += int64(len(skipped))
+		if err == io.EOF {
+			return "", start, start, nil
+		} else if err != nil {
+			return "", start, start, err
+		}
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", start, start, err
+	}
+	end := start + int64(len(line))
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(strings.TrimSpace(line)), start, end, nil
+}
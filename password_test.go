@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInBreachedList(t *testing.T) {
+	// testdata/breached.txt is sorted by hash with CRLF line endings, every other line has a count
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		{"password-manager", true},             // first line, HASH:COUNT
+		{"blue-mountain-77", true},             // HASH
+		{"correct horse battery staple", true}, // in the middle
+		{"hunter2hunter2", true},               // last line
+		{"not in the list at all", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		breached, err := inBreachedList("testdata/breached.txt", test.password)
+		if err != nil || breached != test.breached {
+			t.Errorf("%q: got %v, %v", test.password, breached, err)
+		}
+	}
+}
+
+func TestInBreachedListWithoutTrailingNewline(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/breached.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := ioutil.WriteFile(path, []byte(strings.TrimRight(string(data), "\r\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if breached, err := inBreachedList(path, "hunter2hunter2"); err != nil || !breached {
+		t.Errorf("got %v, %v for the last line", breached, err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if breached, err := inBreachedList(empty, "hunter2hunter2"); err != nil || breached {
+		t.Errorf("got %v, %v for an empty list", breached, err)
+	}
+
+	if _, err := inBreachedList(filepath.Join(t.TempDir(), "missing.txt"), "hunter2hunter2"); err == nil {
+		t.Error("no error for a missing list")
+	}
+}
+
+func TestCommonPasswordsPassLengthRule(t *testing.T) {
+	policy := passwordPolicy{MinLength: 10, MaxLength: 256}
+	for password := range commonPasswords {
+		if password != strings.ToLower(password) {
+			t.Errorf("%q isn't lower case, it would never match", password)
+		}
+		if err := policy.check("", password); err == nil || err.Error() != "password is too common" {
+			t.Errorf("%q: got %v", password, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"guptaspi/filesystem"
+	"guptaspi/importer"
 	"guptaspi/info"
 	"guptaspi/upload"
 	"log"
@@ -14,6 +15,7 @@ func main() {
 	r := mux.NewRouter()
 
 	r.Use(loggingMiddleware)
+	r.Use(metricsMiddleware)
 
 	amw := authentication{}
 	amw.Initialize()
@@ -21,12 +23,35 @@ func main() {
 	r.Use(amw.Middleware)
 	r.HandleFunc("/auth/login", amw.Login).Methods("GET")
 	r.HandleFunc("/auth/logout", amw.Logout).Methods("GET")
-	r.HandleFunc("/auth/createUser", amw.CreateUser).Methods("POST")
+	r.Handle("/auth/createUser", amw.AdminMiddleware(http.HandlerFunc(amw.CreateUser))).Methods("POST")
 	r.HandleFunc("/auth/refresh", amw.Refresh).Methods("POST")
-
+	r.HandleFunc("/auth/changePassword", amw.ChangePassword).Methods("POST")
+	amw.AddSigningKeyRouter(r)
+	r.Handle("/metrics", newMetricsAuth(amw.trustedProxies)).Methods("GET")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(amw.AdminMiddleware)
+	amw.AddUserRouter(admin)
+	amw.AddAuditRouter(admin)
+	amw.AddVolumeRouter(admin)
+
+	info.SetDiscoveryRules(info.DiscoveryRulesFromEnv())
+	info.SetReadOnlyVolumes(info.ReadOnlyVolumesFromEnv())
+	if err := amw.LoadVolumeRegistry(); err != nil {
+		log.Fatalf("Error loading volume registry: %v", err)
+	}
+	info.SetAlertConfig(info.AlertConfigFromEnv())
+	info.SetEjectCommand(info.EjectCommandFromEnv())
+	info.SetCapacityHistoryFile(info.CapacityHistoryFileFromEnv())
+	info.SetSmartConfig(info.SmartConfigFromEnv())
+	info.SetGuardConfig(info.GuardConfigFromEnv())
 	info.AddInfoRouter(r)
+	filesystem.UsageConfigFromEnv()
 	filesystem.AddFileSystemRouter(r)
 	upload.AddUploadRouter(r)
+	importer.SetRules(importer.RulesFromEnv())
+	importer.SetIndexFile(importer.IndexFileFromEnv())
+	importer.AddImportRouter(r)
 
 	http.Handle("/", r)
 
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"guptaspi/auth"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: GPI-HMAC-SHA256 KeyId=<id>,Timestamp=<unix seconds>,Nonce=<random>,SignedHeaders=<a;b>,Signature=<hex>
+//
+// The signature is the hex encoded HMAC-SHA256, keyed with the key's secret, over the lines
+//
+//	METHOD
+//	escaped path
+//	raw query
+//	timestamp
+//	nonce
+//	name:value of every signed header, lowercased and in the order of SignedHeaders
+//	hex encoded SHA-256 of the body, as sent in the X-Content-SHA256 header
+//
+// Requests without a body may leave out X-Content-SHA256, the SHA-256 of an empty body is signed then.
+const signatureScheme = "GPI-HMAC-SHA256"
+
+// contentHashHeader carries the hex encoded SHA-256 of the body of a signed request.
+// The body is checked against it while the handler reads it, so it needn't be buffered.
+const contentHashHeader = "X-Content-SHA256"
+
+// maxClockSkew is how far a request's timestamp may be from the server's clock
+const maxClockSkew = 5 * time.Minute
+
+// errBodyMismatch is returned by the body of a signed request once it was read and doesn't match the signed hash.
+var errBodyMismatch = errors.New("body doesn't match the signed " + contentHashHeader)
+
+var emptyBodyHash = sha256.Sum256(nil)
+
+type SigningKey struct {
+	KeyId           string     `json:"key_id"`
+	Name            string     `json:"name"`
+	Secret          string     `json:"secret,omitempty"`
+	AllowedNetworks string     `json:"allowed_networks"`
+	Created         time.Time  `json:"created"`
+	LastUsed        *time.Time `json:"last_used"`
+}
+
+type signatureParams struct {
+	KeyId         string
+	Timestamp     int64
+	Nonce         string
+	SignedHeaders []string
+	Signature     []byte
+}
+
+// nonceCache remembers nonces for as long as their timestamp is acceptable, so a captured request can't be replayed.
+type nonceCache struct {
+	lock   sync.Mutex
+	nonces map[string]time.Time
+}
+
+// add records the nonce and returns false if it was already seen.
+func (c *nonceCache) add(keyId string, nonce string, expires time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.nonces == nil {
+		c.nonces = map[string]time.Time{}
+	}
+
+	now := time.Now()
+	for k, e := range c.nonces {
+		if e.Before(now) {
+			delete(c.nonces, k)
+		}
+	}
+
+	k := keyId + ":" + nonce
+	if _, ok := c.nonces[k]; ok {
+		return false
+	}
+	c.nonces[k] = expires
+	return true
+}
+
+func isSignedRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), signatureScheme+" ")
+}
+
+func parseSignatureParams(header string) (*signatureParams, error) {
+	p := signatureParams{}
+	for _, field := range strings.Split(strings.TrimPrefix(header, signatureScheme+" "), ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("malformed signature field %q", field)
+		}
+		var err error
+		switch keyValue[0] {
+		case "KeyId":
+			p.KeyId = keyValue[1]
+		case "Timestamp":
+			p.Timestamp, err = strconv.ParseInt(keyValue[1], 10, 64)
+		case "Nonce":
+			p.Nonce = keyValue[1]
+		case "SignedHeaders":
+			if keyValue[1] != "" {
+				p.SignedHeaders = strings.Split(strings.ToLower(keyValue[1]), ";")
+			}
+		case "Signature":
+			p.Signature, err = hex.DecodeString(keyValue[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed signature field %q", field)
+		}
+	}
+	if p.KeyId == "" || p.Timestamp == 0 || p.Nonce == "" || len(p.Signature) == 0 {
+		return nil, fmt.Errorf("incomplete signature")
+	}
+	return &p, nil
+}
+
+// stringToSign builds the canonical representation of the request that is signed.
+func stringToSign(r *http.Request, p *signatureParams, bodyHash []byte) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(r.URL.EscapedPath() + "\n")
+	b.WriteString(r.URL.RawQuery + "\n")
+	b.WriteString(strconv.FormatInt(p.Timestamp, 10) + "\n")
+	b.WriteString(p.Nonce + "\n")
+	for _, name := range p.SignedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		b.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	b.WriteString(hex.EncodeToString(bodyHash))
+	return b.String()
+}
+
+// verifySignature authenticates a request signed with one of the user's signing keys.
+// The signature covers the body hash the client claims, the body is checked against it as the handler reads it.
+func (amw *authentication) verifySignature(r *http.Request) (*auth.Identity, error) {
+	p, err := parseSignatureParams(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+
+	timestamp := time.Unix(p.Timestamp, 0)
+	if skew := time.Since(timestamp); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, fmt.Errorf("%w: timestamp outside of allowed clock skew", errUnauthorized)
+	}
+
+	identity := auth.Identity{KeyId: p.KeyId}
+	var secret string
+	var disabled bool
+	var userNetworks, keyNetworks string
+	err = amw.db.QueryRow(
+		`SELECT u.id, u.username, u.role, u.disabled, u.allowed_networks, k.secret, k.allowed_networks
+		FROM signing_keys k JOIN users u ON u.id = k.user_id WHERE k.key_id = ?`,
+		p.KeyId,
+	).Scan(&identity.UserId, &identity.Username, &identity.Role, &disabled, &userNetworks, &secret, &keyNetworks)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, fmt.Errorf("%w: unknown key %s", errUnauthorized, p.KeyId)
+	case err != nil:
+		return nil, err
+	}
+
+	bodyHash := emptyBodyHash[:]
+	if header := r.Header.Get(contentHashHeader); header != "" {
+		bodyHash, err = hex.DecodeString(header)
+		if err != nil || len(bodyHash) != sha256.Size {
+			return nil, fmt.Errorf("%w: malformed %s", errUnauthorized, contentHashHeader)
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign(r, p, bodyHash)))
+	if !hmac.Equal(mac.Sum(nil), p.Signature) {
+		return nil, fmt.Errorf("%w: signature mismatch for key %s", errUnauthorized, p.KeyId)
+	}
+
+	// Only remember nonces of valid signatures, so they can't be used to block legitimate requests
+	if !amw.nonces.add(p.KeyId, p.Nonce, timestamp.Add(maxClockSkew)) {
+		return nil, fmt.Errorf("%w: replayed nonce for key %s", errUnauthorized, p.KeyId)
+	}
+
+	if disabled {
+		return &identity, fmt.Errorf("%w: user %s is disabled", errForbidden, identity.Username)
+	}
+	if ip := clientIP(r, amw.trustedProxies); !networksAllow(ip, userNetworks, keyNetworks) {
+		return &identity, fmt.Errorf("%w: address %v not allowed for user %s", errForbidden, ip, identity.Username)
+	}
+
+	_, err = amw.db.Exec("UPDATE signing_keys SET last_used = ? WHERE key_id = ?", time.Now(), p.KeyId)
+	if err != nil {
+		log.Printf("Error updating key usage: %v\n", err)
+	}
+
+	if r.Body != nil {
+		r.Body = newVerifyingBody(r.Body, r.ContentLength, bodyHash)
+	}
+
+	return &identity, nil
+}
+
+// verifyingBody hashes a request body as it is read and fails the read that completes it if the hash doesn't match.
+// A body is complete at EOF or once its Content-Length was read, as handlers like the upload's read exactly that much.
+// The failing read returns no data, so io.ReadFull and json.Decoder don't swallow the error with the last bytes.
+type verifyingBody struct {
+	io.Closer
+	reader   io.Reader
+	hasher   hash.Hash
+	expected []byte
+	length   int64
+	read     int64
+	err      error
+}
+
+func newVerifyingBody(body io.ReadCloser, length int64, expected []byte) *verifyingBody {
+	hasher := sha256.New()
+	return &verifyingBody{
+		Closer:   body,
+		reader:   io.TeeReader(body, hasher),
+		hasher:   hasher,
+		expected: expected,
+		length:   length,
+	}
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	if err == io.EOF || (b.length >= 0 && b.read >= b.length) {
+		if !hmac.Equal(b.hasher.Sum(nil), b.expected) {
+			b.err = errBodyMismatch
+			return 0, b.err
+		}
+	}
+	return n, err
+}
+
+// AddSigningKeyRouter installs the endpoints with which users manage their own signing keys.
+func (amw *authentication) AddSigningKeyRouter(r *mux.Router) {
+	r.HandleFunc("/auth/keys", amw.listSigningKeys).Methods("GET")
+	r.HandleFunc("/auth/keys", amw.createSigningKey).Methods("POST")
+	r.HandleFunc("/auth/keys/{keyId}", amw.deleteSigningKey).Methods("DELETE")
+}
+
+// sessionIdentity returns the identity of a request authenticated with an access token.
+// Signing keys can't be used to manage signing keys.
+func sessionIdentity(w http.ResponseWriter, r *http.Request) (*auth.Identity, bool) {
+	identity, ok := auth.FromRequest(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+	if identity.KeyId != "" {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	return identity, true
+}
+
+func (amw *authentication) listSigningKeys(w http.ResponseWriter, r *http.Request) {
+	identity, ok := sessionIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := amw.db.Query(
+		"SELECT key_id, name, allowed_networks, created, last_used FROM signing_keys WHERE user_id = ? ORDER BY created",
+		identity.UserId,
+	)
+	if err != nil {
+		log.Printf("Error when querying signing keys: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+	for rows.Next() {
+		key := SigningKey{}
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&key.KeyId, &key.Name, &key.AllowedNetworks, &key.Created, &lastUsed); err != nil {
+			log.Printf("Error when scanning signing keys: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if lastUsed.Valid {
+			key.LastUsed = &lastUsed.Time
+		}
+		keys = append(keys, &key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(keys)
+}
+
+// createSigningKey creates a key for the logged in user. The secret is only ever returned here.
+func (amw *authentication) createSigningKey(w http.ResponseWriter, r *http.Request) {
+	identity, ok := sessionIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	body := struct {
+		Name            string `json:"name"`
+		AllowedNetworks string `json:"allowed_networks"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("Error decoding JSON: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	networks, err := parseNetworks(body.AllowedNetworks)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	keyId, err := randomHex(12)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	key := SigningKey{
+		KeyId:           keyId,
+		Name:            body.Name,
+		Secret:          secret,
+		AllowedNetworks: networks.String(),
+		Created:         time.Now().UTC().Truncate(time.Second),
+	}
+
+	_, err = amw.db.Exec(
+		"INSERT INTO signing_keys (key_id, user_id, name, secret, allowed_networks, created) VALUES (?, ?, ?, ?, ?, ?)",
+		key.KeyId, identity.UserId, key.Name, key.Secret, key.AllowedNetworks, key.Created,
+	)
+	if err != nil {
+		log.Printf("Error creating signing key: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	amw.audit(r, eventKeyCreated, outcomeSuccess, identity.UserId, identity.Username, "key "+key.KeyId)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(key)
+}
+
+func (amw *authentication) deleteSigningKey(w http.ResponseWriter, r *http.Request) {
+	identity, ok := sessionIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	keyId := mux.Vars(r)["keyId"]
+	res, err := amw.db.Exec("DELETE FROM signing_keys WHERE key_id = ? AND user_id = ?", keyId, identity.UserId)
+	if err != nil {
+		log.Printf("Error deleting signing key: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	amw.audit(r, eventKeyDeleted, outcomeSuccess, identity.UserId, identity.Username, "key "+keyId)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -1,10 +1,16 @@
 package upload
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"guptaspi/auth"
 	"guptaspi/info"
+	"guptaspi/metrics"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -16,14 +22,46 @@ import (
 )
 
 type Upload struct {
+	UserId uint64
+	Volume string
+	// Drive is the Id of the drive the file is written to, which differs from Volume for pools
+	Drive          string
+	root           string
+	RelativePath   string
 	FilePath       string
 	FileSize       uint64
 	Offset         uint64
 	ExpirationDate time.Time
 }
 
+// CompletionHandler is called once an upload has received all of its bytes.
+type CompletionHandler func(upload *Upload)
+
 var uploadMap = map[uuid.UUID]*Upload{}
 var lock = sync.RWMutex{}
+var completionHandler CompletionHandler
+
+// activeWrites counts the PATCH requests writing to each drive. It is guarded by lock.
+var activeWrites = map[string]int{}
+
+var (
+	activeUploadsGauge = metrics.NewGaugeFunc(
+		"guptaspi_uploads_active", "Number of tus uploads that are in progress.", nil,
+		func() []metrics.Sample {
+			lock.RLock()
+			defer lock.RUnlock()
+			return []metrics.Sample{{Value: float64(len(uploadMap))}}
+		},
+	)
+	receivedBytesCounter = metrics.NewCounter(
+		"guptaspi_upload_received_bytes_total", "Bytes written to files by tus uploads.",
+	)
+)
+
+// SetCompletionHandler registers h to be called whenever an upload finishes.
+func SetCompletionHandler(h CompletionHandler) {
+	completionHandler = h
+}
 
 func AddUploadRouter(r *mux.Router) {
 	r.HandleFunc("/upload/{volume}", startUpload).Methods("POST")
@@ -31,6 +69,8 @@ func AddUploadRouter(r *mux.Router) {
 	r.HandleFunc("/upload/{id}", patchUpload).Methods("PATCH")
 	r.HandleFunc("/upload/{id}", terminateUpload).Methods("DELETE")
 	r.HandleFunc("/upload", options).Methods("OPTIONS")
+
+	info.AddEjectHandler(drainUploads)
 }
 
 func startUpload(w http.ResponseWriter, r *http.Request) {
@@ -72,7 +112,18 @@ func startUpload(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(400)
 		return
 	}
-	filePath := string(filePathBytes)
+	// The file stays on the volume, paths that climb out of it or name no file are refused
+	for _, name := range strings.Split(filepath.ToSlash(string(filePathBytes)), "/") {
+		if name == ".." {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	relativePath := filepath.Clean("/" + string(filePathBytes))
+	if relativePath == string(filepath.Separator) {
+		w.WriteHeader(400)
+		return
+	}
 
 	drive := info.GetDrive(volume)
 
@@ -81,7 +132,10 @@ func startUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath = filepath.Join(drive.Path, filePath)
+	if err := drive.CheckWritable(); err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
 
 	var uploadLength uint64
 
@@ -108,9 +162,25 @@ func startUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Pools place the file on one of their members, which may not have the folder yet
+	target, err := drive.PlaceFile(relativePath, uploadLength)
+	if err != nil {
+		http.Error(w, err.Error(), info.ErrorStatus(err))
+		return
+	}
+	filePath := filepath.Join(target.Path, relativePath)
+	if target != drive {
+		err := info.Guard(target.Path, func() error { return os.MkdirAll(filepath.Dir(filePath), 0777) })
+		if err != nil {
+			log.Printf("Folder creation error: %v", err)
+			w.WriteHeader(info.ErrorStatus(err))
+			return
+		}
+	}
+
 	// File creation
-	c := make(chan int)
-	go createFile(filePath, overwrite, uploadLength, c)
+	c := make(chan int, 2)
+	go guardStatus(target.Path, c, func() { createFile(filePath, overwrite, uploadLength, c) })
 
 	// UUID generation
 	id, err := uuid.NewRandom()
@@ -120,7 +190,17 @@ func startUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var userId uint64
+	if identity, ok := auth.FromRequest(r); ok {
+		userId = identity.UserId
+	}
+
 	upload := Upload{
+		UserId:         userId,
+		Volume:         drive.Id,
+		Drive:          target.Id,
+		root:           target.Path,
+		RelativePath:   relativePath,
 		FilePath:       filePath,
 		FileSize:       uploadLength,
 		Offset:         0,
@@ -179,6 +259,15 @@ func patchUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The volume may have been remounted read-only since the upload started.
+	// Ejects wait for uploads that are under way, so those may still finish.
+	if drive := info.GetDrive(upload.Volume); drive != nil {
+		if err := drive.CheckWritable(); err != nil && !errors.Is(err, info.ErrEjecting) {
+			http.Error(w, err.Error(), info.ErrorStatus(err))
+			return
+		}
+	}
+
 	var fileSize uint64
 	if upload.FileSize == 0 {
 		if deferLength := r.Header.Get("Upload-Defer-Length"); deferLength != "" {
@@ -217,8 +306,9 @@ func patchUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The body of a signed request is verified by the read that completes it
 	buffer := make([]byte, r.ContentLength)
-	_, err = r.Body.Read(buffer)
+	_, err = io.ReadFull(r.Body, buffer)
 	if err != nil {
 		log.Printf("Error reading body: %v", err)
 		w.WriteHeader(500)
@@ -239,22 +329,34 @@ func patchUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	c := make(chan int)
-	go writeToFile(upload.FilePath, buffer, int64(upload.Offset), c)
+	// The upload may have been cancelled by an eject while the body was read
+	id, _ := uuid.Parse(idString)
+	if !beginWrite(id, upload) {
+		w.WriteHeader(404)
+		return
+	}
+	c := make(chan int, 2)
+	go guardStatus(upload.root, c, func() { writeToFile(upload.FilePath, buffer, int64(upload.Offset), c) })
+	code := <-c
+	endWrite(upload)
 
-	if code := <-c; code != 204 {
+	if code != 204 {
 		w.WriteHeader(code)
 		return
 	}
 	upload.Offset += uint64(len(buffer))
 	upload.FileSize = fileSize
+	receivedBytesCounter.Add(float64(len(buffer)))
 
 	if upload.FileSize != 0 && upload.FileSize == upload.Offset {
 		log.Printf("Upload to %s finished", upload.FilePath)
-		id, _ := uuid.Parse(idString)
 		lock.Lock()
 		delete(uploadMap, id)
 		lock.Unlock()
+
+		if completionHandler != nil {
+			completionHandler(upload)
+		}
 	}
 
 	w.Header().Add("Tus-Resumable", "1.0.0")
@@ -277,13 +379,21 @@ func terminateUpload(w http.ResponseWriter, r *http.Request) {
 	lock.Lock()
 	upload, ok := uploadMap[id]
 	if !ok {
+		lock.Unlock()
 		w.WriteHeader(404)
 		return
 	}
+	if drive := info.GetDrive(upload.Volume); drive != nil {
+		if err := drive.CheckWritable(); err != nil && !errors.Is(err, info.ErrEjecting) {
+			lock.Unlock()
+			http.Error(w, err.Error(), info.ErrorStatus(err))
+			return
+		}
+	}
 	delete(uploadMap, id)
 	lock.Unlock()
 
-	err = os.Remove(upload.FilePath)
+	err = info.Guard(upload.root, func() error { return os.Remove(upload.FilePath) })
 	if err != nil {
 		log.Printf("Error removing file: %v", err)
 	}
@@ -292,6 +402,83 @@ func terminateUpload(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+// guardStatus runs fn, which sends its status code on c, with the deadline of the volume at root.
+// A volume that doesn't respond gets 503 instead, so c needs room for the late status of fn as well.
+func guardStatus(root string, c chan int, fn func()) {
+	err := info.Guard(root, func() error {
+		fn()
+		return nil
+	})
+	if err != nil {
+		c <- info.ErrorStatus(err)
+	}
+}
+
+// beginWrite registers a write to the upload's volume, unless the upload was removed in the meantime.
+func beginWrite(id uuid.UUID, upload *Upload) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if uploadMap[id] != upload {
+		return false
+	}
+	activeWrites[upload.Drive]++
+	return true
+}
+
+func endWrite(upload *Upload) {
+	lock.Lock()
+	activeWrites[upload.Drive]--
+	if activeWrites[upload.Drive] == 0 {
+		delete(activeWrites, upload.Drive)
+	}
+	lock.Unlock()
+}
+
+// drainUploads is called when a volume is ejected. It waits until every upload to the volume finished,
+// or with cancel removes them and their partial files, then waits for writes that are under way.
+func drainUploads(ctx context.Context, volume string, cancel bool) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		var cancelled []*Upload
+		pending := 0
+
+		lock.Lock()
+		for id, upload := range uploadMap {
+			if upload.Drive != volume {
+				continue
+			}
+			if cancel {
+				delete(uploadMap, id)
+				cancelled = append(cancelled, upload)
+			} else {
+				pending++
+			}
+		}
+		pending += activeWrites[volume]
+		lock.Unlock()
+
+		for _, upload := range cancelled {
+			log.Printf("Cancelled upload to %s for eject", upload.FilePath)
+			filePath := upload.FilePath
+			if err := info.Guard(upload.root, func() error { return os.Remove(filePath) }); err != nil {
+				log.Printf("Error removing file: %v", err)
+			}
+		}
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d uploads still in progress: %w", pending, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
 func options(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Add("Tus-Resumable", "1.0.0")
 	w.Header().Add("Tus-Version", "1.0.0")
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"guptaspi/auth"
+	"guptaspi/info"
+	"guptaspi/upload"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UserDetails struct {
+	Id              uint64     `json:"id"`
+	Username        string     `json:"username"`
+	Role            string     `json:"role"`
+	Disabled        bool       `json:"disabled"`
+	LastLogin       *time.Time `json:"last_login"`
+	AllowedNetworks string     `json:"allowed_networks"`
+	ActiveSessions  uint64     `json:"active_sessions"`
+	StorageUsed     uint64     `json:"storage_used"`
+}
+
+func validRole(role string) bool {
+	return role == auth.RoleAdmin || role == auth.RoleUser
+}
+
+// AddUserRouter installs the admin user-management endpoints.
+// r is a subrouter that is already restricted to admins.
+func (amw *authentication) AddUserRouter(r *mux.Router) {
+	r.HandleFunc("/users", amw.listUsers).Methods("GET")
+	r.HandleFunc("/users/{id}", amw.getUser).Methods("GET")
+	r.HandleFunc("/users/{id}", amw.updateUser).Methods("PATCH")
+	r.HandleFunc("/users/{id}", amw.deleteUser).Methods("DELETE")
+
+	upload.SetCompletionHandler(amw.recordFile)
+}
+
+const userDetailsQuery = `SELECT u.id, u.username, u.role, u.disabled, u.last_login, u.allowed_networks,
+	(SELECT COUNT(*) FROM refresh_tokens t WHERE t.user_id = u.id AND t.expires > ?),
+	(SELECT COALESCE(SUM(f.size), 0) FROM files f WHERE f.user_id = u.id)
+	FROM users u`
+
+func scanUserDetails(row interface{ Scan(...interface{}) error }) (*UserDetails, error) {
+	user := UserDetails{}
+	var lastLogin sql.NullTime
+	err := row.Scan(&user.Id, &user.Username, &user.Role, &user.Disabled, &lastLogin, &user.AllowedNetworks, &user.ActiveSessions, &user.StorageUsed)
+	if err != nil {
+		return nil, err
+	}
+	if lastLogin.Valid {
+		user.LastLogin = &lastLogin.Time
+	}
+	return &user, nil
+}
+
+// listUsers corresponds to the GET /admin/users endpoint.
+func (amw *authentication) listUsers(w http.ResponseWriter, _ *http.Request) {
+	rows, err := amw.db.Query(userDetailsQuery+" ORDER BY u.id", time.Now())
+	if err != nil {
+		log.Printf("Error when querying users: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []*UserDetails{}
+	for rows.Next() {
+		user, err := scanUserDetails(rows)
+		if err != nil {
+			log.Printf("Error when scanning users: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error when querying users: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(users)
+}
+
+// getUser corresponds to the GET /admin/users/{id} endpoint.
+func (amw *authentication) getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := scanUserDetails(amw.db.QueryRow(userDetailsQuery+" WHERE u.id = ?", time.Now(), id))
+	switch {
+	case err == sql.ErrNoRows:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Error when querying user: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(user)
+}
+
+// updateUser corresponds to the PATCH /admin/users/{id} endpoint.
+// Only the fields present in the body are changed. Changing the password or disabling the user revokes their tokens.
+func (amw *authentication) updateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	body := struct {
+		Username *string `json:"username"`
+		Password *string `json:"password"`
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+		// AllowedNetworks is a comma separated list of CIDRs, empty allows every address
+		AllowedNetworks *string `json:"allowed_networks"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("Error decoding JSON: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.Username != nil && *body.Username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.Role != nil && !validRole(*body.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.AllowedNetworks != nil {
+		networks, err := parseNetworks(*body.AllowedNetworks)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		normalized := networks.String()
+		body.AllowedNetworks = &normalized
+	}
+
+	var hash string
+	if body.Password != nil {
+		var username string
+		if body.Username != nil {
+			username = *body.Username
+		} else if err := amw.db.QueryRow("SELECT username FROM users WHERE id = ?", id).Scan(&username); err != nil && err != sql.ErrNoRows {
+			log.Printf("Error when querying user: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := amw.passwordPolicy.check(username, *body.Password); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if hash, err = hashPassword(*body.Password); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Admins can't lock themselves out
+	if identity, ok := auth.FromRequest(r); ok && identity.UserId == id {
+		if (body.Role != nil && *body.Role != auth.RoleAdmin) || (body.Disabled != nil && *body.Disabled) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+
+	tx, err := amw.db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists); err != nil || !exists {
+		_ = tx.Rollback()
+		if err != nil {
+			log.Printf("Error when querying user: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if body.Username != nil {
+		if _, err := tx.Exec("UPDATE users SET username = ? WHERE id = ?", *body.Username, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error renaming user: %v\n", err)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+	if body.Password != nil {
+		if _, err := tx.Exec("UPDATE users SET password = ? WHERE id = ?", hash, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error changing password: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if body.Role != nil {
+		if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", *body.Role, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error changing role: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if body.Disabled != nil {
+		if _, err := tx.Exec("UPDATE users SET disabled = ? WHERE id = ?", *body.Disabled, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error changing disabled state: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if body.AllowedNetworks != nil {
+		if _, err := tx.Exec("UPDATE users SET allowed_networks = ? WHERE id = ?", *body.AllowedNetworks, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error changing allowed networks: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if body.Password != nil || (body.Disabled != nil && *body.Disabled) {
+		if err := revokeTokens(tx, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error revoking tokens: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var changes []string
+	if body.Username != nil {
+		changes = append(changes, "username "+*body.Username)
+	}
+	if body.Role != nil {
+		changes = append(changes, "role "+*body.Role)
+	}
+	if body.Disabled != nil {
+		changes = append(changes, "disabled "+strconv.FormatBool(*body.Disabled))
+	}
+	if body.AllowedNetworks != nil {
+		changes = append(changes, "allowed networks "+*body.AllowedNetworks)
+	}
+	by := "by " + actorName(r)
+	if len(changes) > 0 {
+		amw.audit(r, eventUserUpdated, outcomeSuccess, id, "", strings.Join(changes, ", ")+" "+by)
+	}
+	if body.Password != nil {
+		amw.audit(r, eventPasswordChanged, outcomeSuccess, id, "", "reset "+by)
+	}
+	if body.Password != nil || (body.Disabled != nil && *body.Disabled) {
+		amw.audit(r, eventTokensRevoked, outcomeSuccess, id, "", by)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeTokens deletes all access and refresh tokens of the user.
+func revokeTokens(tx *sql.Tx, userId uint64) error {
+	for _, stmt := range []string{
+		"DELETE FROM access_tokens WHERE user_id = ?",
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUser corresponds to the DELETE /admin/users/{id} endpoint.
+// The files query param decides what happens to the user's uploads: keep (default), reassign or remove.
+func (amw *authentication) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if identity, ok := auth.FromRequest(r); ok && identity.UserId == id {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	files := r.FormValue("files")
+	if files == "" {
+		files = "keep"
+	}
+	var reassignTo uint64
+	switch files {
+	case "keep", "remove":
+	case "reassign":
+		reassignTo, err = strconv.ParseUint(r.FormValue("reassign_to"), 10, 64)
+		if err != nil || reassignTo == id {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := amw.db.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if files == "reassign" {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", reassignTo).Scan(&exists); err != nil || !exists {
+			_ = tx.Rollback()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec("UPDATE files SET user_id = ? WHERE user_id = ?", reassignTo, id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error reassigning files: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var removed []string
+	if files == "remove" {
+		removed, err = amw.userFilePaths(tx, id)
+		if err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error querying files: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM files WHERE user_id = ?", id); err != nil {
+			_ = tx.Rollback()
+			log.Printf("Error deleting files: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := revokeTokens(tx, id); err != nil {
+		_ = tx.Rollback()
+		log.Printf("Error revoking tokens: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM signing_keys WHERE user_id = ?", id); err != nil {
+		_ = tx.Rollback()
+		log.Printf("Error deleting signing keys: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		_ = tx.Rollback()
+		log.Printf("Error deleting user: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, path := range removed {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing file: %v", err)
+		}
+	}
+
+	by := "by " + actorName(r)
+	amw.audit(r, eventTokensRevoked, outcomeSuccess, id, "", by)
+	amw.audit(r, eventUserDeleted, outcomeSuccess, id, "", "files "+files+" "+by)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userFilePaths returns the absolute paths of the files uploaded by the user on volumes that are currently available.
+func (amw *authentication) userFilePaths(tx *sql.Tx, userId uint64) ([]string, error) {
+	rows, err := tx.Query("SELECT volume, path FROM files WHERE user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var volume, path string
+		if err := rows.Scan(&volume, &path); err != nil {
+			return nil, err
+		}
+		drive := info.GetDrive(volume)
+		if drive == nil {
+			log.Printf("Volume %s of file %s is unavailable, leaving it in place", volume, path)
+			continue
+		}
+		paths = append(paths, drive.Locate(path))
+	}
+	return paths, rows.Err()
+}
+
+// recordFile stores the owner of a finished upload, so storage can be accounted per user.
+func (amw *authentication) recordFile(u *upload.Upload) {
+	_, err := amw.db.Exec(
+		"INSERT INTO files (user_id, volume, path, size, created) VALUES (?, ?, ?, ?, ?)",
+		u.UserId, u.Volume, u.RelativePath, u.Offset, time.Now(),
+	)
+	if err != nil {
+		log.Printf("Error recording file: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"guptaspi/info"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AddVolumeRouter installs the admin endpoints of the volume registry.
+// r is a subrouter that is already restricted to admins.
+func (amw *authentication) AddVolumeRouter(r *mux.Router) {
+	r.HandleFunc("/volumes", amw.listVolumes).Methods("GET")
+	r.HandleFunc("/volumes", amw.createVolume).Methods("POST")
+	r.HandleFunc("/volumes/{id}", amw.updateVolume).Methods("PATCH")
+	r.HandleFunc("/volumes/{id}", amw.deleteVolume).Methods("DELETE")
+}
+
+const volumeEntryQuery = "SELECT id, kind, path, alias, hidden, display_order, members, policy FROM volumes"
+
+// scanVolumeEntry reads a row of volumeEntryQuery. Pool members are stored comma separated.
+func scanVolumeEntry(row interface{ Scan(...interface{}) error }) (*info.VolumeEntry, error) {
+	entry := info.VolumeEntry{}
+	var members string
+	err := row.Scan(&entry.Id, &entry.Kind, &entry.Path, &entry.Alias, &entry.Hidden, &entry.DisplayOrder, &members, &entry.Policy)
+	if err != nil {
+		return nil, err
+	}
+	if members != "" {
+		entry.Members = strings.Split(members, ",")
+	}
+	return &entry, nil
+}
+
+func (amw *authentication) queryVolumeEntries() ([]info.VolumeEntry, error) {
+	rows, err := amw.db.Query(volumeEntryQuery + " ORDER BY display_order, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []info.VolumeEntry{}
+	for rows.Next() {
+		entry, err := scanVolumeEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, rows.Err()
+}
+
+// LoadVolumeRegistry hands the registry stored in the database to info. It is called on start and after every change.
+func (amw *authentication) LoadVolumeRegistry() error {
+	entries, err := amw.queryVolumeEntries()
+	if err != nil {
+		return err
+	}
+	info.SetVolumeRegistry(entries)
+	return nil
+}
+
+// reloadVolumes applies a change to the registry, which is already committed, so failing to load it is only logged.
+func (amw *authentication) reloadVolumes() {
+	if err := amw.LoadVolumeRegistry(); err != nil {
+		log.Printf("Error loading volume registry: %v\n", err)
+	}
+}
+
+// listVolumes corresponds to the GET /admin/volumes endpoint.
+func (amw *authentication) listVolumes(w http.ResponseWriter, _ *http.Request) {
+	entries, err := amw.queryVolumeEntries()
+	if err != nil {
+		log.Printf("Error when querying volumes: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// createVolume corresponds to the POST /admin/volumes endpoint.
+// Directory volumes and pools can't take the Id of a drive that is currently mounted.
+func (amw *authentication) createVolume(w http.ResponseWriter, r *http.Request) {
+	entry := info.VolumeEntry{}
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		log.Printf("Error decoding JSON: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := entry.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if drive := info.GetDrive(entry.Id); entry.Kind != info.VolumeKindDrive && drive != nil && drive.Id == entry.Id {
+		writeError(w, http.StatusConflict, "a drive with this id exists")
+		return
+	}
+
+	_, err := amw.db.Exec(
+		"INSERT INTO volumes (id, kind, path, alias, hidden, display_order, members, policy) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.Id, entry.Kind, entry.Path, entry.Alias, entry.Hidden, entry.DisplayOrder, strings.Join(entry.Members, ","), entry.Policy,
+	)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		writeError(w, http.StatusConflict, "a volume with this id exists")
+		return
+	} else if err != nil {
+		log.Printf("Error creating volume: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	amw.reloadVolumes()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// updateVolume corresponds to the PATCH /admin/volumes/{id} endpoint.
+// Only the fields present in the body are changed, the kind can't be.
+func (amw *authentication) updateVolume(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	entry, err := scanVolumeEntry(amw.db.QueryRow(volumeEntryQuery+" WHERE id = ?", id))
+	switch {
+	case err == sql.ErrNoRows:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Error when querying volume: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body := struct {
+		Path         *string   `json:"path"`
+		Alias        *string   `json:"alias"`
+		Hidden       *bool     `json:"hidden"`
+		DisplayOrder *int      `json:"display_order"`
+		Members      *[]string `json:"members"`
+		Policy       *string   `json:"policy"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("Error decoding JSON: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.Path != nil {
+		entry.Path = *body.Path
+	}
+	if body.Alias != nil {
+		entry.Alias = *body.Alias
+	}
+	if body.Hidden != nil {
+		entry.Hidden = *body.Hidden
+	}
+	if body.DisplayOrder != nil {
+		entry.DisplayOrder = *body.DisplayOrder
+	}
+	if body.Members != nil {
+		entry.Members = *body.Members
+	}
+	if body.Policy != nil {
+		entry.Policy = *body.Policy
+	}
+	if err := entry.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = amw.db.Exec(
+		"UPDATE volumes SET path = ?, alias = ?, hidden = ?, display_order = ?, members = ?, policy = ? WHERE id = ?",
+		entry.Path, entry.Alias, entry.Hidden, entry.DisplayOrder, strings.Join(entry.Members, ","), entry.Policy, id,
+	)
+	if err != nil {
+		log.Printf("Error updating volume: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	amw.reloadVolumes()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// deleteVolume corresponds to the DELETE /admin/volumes/{id} endpoint.
+// Drives go back to their discovered label, directory volumes disappear. No files are touched.
+func (amw *authentication) deleteVolume(w http.ResponseWriter, r *http.Request) {
+	result, err := amw.db.Exec("DELETE FROM volumes WHERE id = ?", mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Error deleting volume: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	amw.reloadVolumes()
+
+	w.WriteHeader(http.StatusNoContent)
+}